@@ -139,10 +139,12 @@ function enrollAndRegisterUsers() {
         // Set this user as the chain's registrar which is authorized to register other users.
         chain.setRegistrar(admin);
 
-        //creating a new user
+        //creating a new user, with the certificate attributes the chaincode
+        //checks before running a function
         var registrationRequest = {
             enrollmentID: newUserName,
-            affiliation: config.user.affiliation
+            affiliation: config.user.affiliation,
+            attributes: config.user.attributes
         };
         chain.registerAndEnroll(registrationRequest, function(err, user) {
             if (err) throw Error(" Failed to register and enroll " + newUserName + ": " + err);
@@ -167,7 +169,9 @@ function deployChaincode() {
         args: args,
         chaincodePath: config.deployRequest.chaincodePath,
         // the location where the startup and HSBN store the certificates
-        certificatePath: network.cert_path
+        certificatePath: network.cert_path,
+        // Certificate attributes to carry in the transaction certificate
+        attrs: getAttrs()
     };
 
     // Trigger the deploy transaction
@@ -201,7 +205,9 @@ function invoke() {
         // Function to trigger
         fcn: config.invokeRequest.functionName,
         // Parameters for the invoke function
-        args: args
+        args: args,
+        // Certificate attributes to carry in the transaction certificate
+        attrs: getAttrs()
     };
 
     // Trigger the invoke transaction
@@ -239,7 +245,9 @@ function query() {
         // Function to trigger
         fcn: config.queryRequest.functionName,
         // Existing state variable to retrieve
-        args: args
+        args: args,
+        // Certificate attributes to carry in the transaction certificate
+        attrs: getAttrs()
     };
 
     // Trigger the query transaction
@@ -266,6 +274,16 @@ function getArgs(request) {
     return args;
 }
 
+// The names of the user's certificate attributes. The chaincode can only read
+// the attributes a transaction asks for.
+function getAttrs() {
+    var attrs = [];
+    for (var i = 0; i < config.user.attributes.length; i++) {
+        attrs.push(config.user.attributes[i].name);
+    }
+    return attrs;
+}
+
 function fileExists(filePath) {
     try {
         return fs.statSync(filePath).isFile();
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Certificate attributes issued by the ACA and read by the access policy
+var roleAttribute = "role"
+var aadharAttribute = "aadhar"
+var holderAttribute = "holder" // bank, creditor or court holding encumbrances
+
+// Roles a caller can hold in its role attribute
+const (
+	roleAdmin     = "admin"
+	roleRegistrar = "registrar"
+	roleNotary    = "notary"
+	roleAuditor   = "auditor"
+)
+
+// policy describes who may call a chaincode function
+type policy struct {
+	// roles allowed to call the function
+	roles []string
+	// party, if set, identifies the party on whose behalf the call is made
+	// by a certificate attribute and its value; a caller holding that value
+	// is also allowed, whatever its role
+	party func(stub shim.ChaincodeStubInterface, args []string) (party, error)
+}
+
+// party is a caller identified by a certificate attribute rather than a role
+type party struct {
+	name      string
+	attribute string
+	value     string
+}
+
+// readRoles are the roles allowed to run the read-only queries
+var readRoles = []string{roleAuditor, roleRegistrar, roleNotary, roleAdmin}
+
+// invokePolicies and queryPolicies hold the policy of every function the
+// chaincode dispatches. A function without a policy cannot be called.
+var invokePolicies = map[string]policy{
+	"init":         {roles: []string{roleAdmin}},
+	"initProperty": {roles: []string{roleRegistrar}},
+	"transfer":     {roles: []string{roleNotary}, party: sellerOf},
+
+	"registerEncumbrance": {roles: []string{roleRegistrar}, party: newHolderOf},
+	"releaseEncumbrance":  {roles: []string{roleRegistrar}, party: holderOf},
+	"consentTransfer":     {party: holderOf},
+
+	"subdivideSurvey": {roles: []string{roleRegistrar}},
+	"mergeSurveys":    {roles: []string{roleRegistrar}},
+	"recordAdjacency": {roles: []string{roleRegistrar}},
+
+	"bulkInitProperties": {roles: []string{roleRegistrar}},
+
+	"proposeSale":  {roles: []string{roleNotary}, party: sellerOf},
+	"acceptSale":   {party: buyerOfSale},
+	"approveSale":  {roles: []string{roleRegistrar}},
+	"finalizeSale": {roles: []string{roleNotary}, party: sellerOfSale},
+	"cancelSale":   {roles: []string{roleRegistrar}, party: partyOfSale},
+
+	"migrateLegacyKeys": {roles: []string{roleAdmin}},
+}
+
+var queryPolicies = map[string]policy{
+	"readInit":              {roles: readRoles},
+	"readOwner":             {roles: readRoles},
+	"readSurvey":            {roles: readRoles},
+	"readOwnerIndex":        {roles: readRoles},
+	"readSurveyIndex":       {roles: readRoles},
+	"readSurveyHistory":     {roles: readRoles},
+	"readSurveyAsOf":        {roles: readRoles},
+	"readSurveyVersions":    {roles: readRoles},
+	"readSurveysByLocation": {roles: readRoles},
+	"readOwnerByAadhar":     {roles: readRoles},
+	"readEncumbrances":      {roles: readRoles},
+	"readSale":              {roles: readRoles},
+	"readPendingSales":      {roles: readRoles},
+	"readExpiredSales":      {roles: readRoles},
+	"simulateTransfer":      {roles: []string{roleAdmin}},
+	"exportRegistry":        {roles: readRoles},
+}
+
+// sellerOf : the seller a transfer is made on behalf of, identified by the
+// Aadhar number
+func sellerOf(stub shim.ChaincodeStubInterface, args []string) (party, error) {
+	if len(args) == 0 {
+		return party{}, errInvalidArgument("Seller not specified")
+	}
+	return ownerParty(stub, args[0])
+}
+
+// ownerParty : a registered owner, identified by the Aadhar number
+func ownerParty(stub shim.ChaincodeStubInterface, name string) (party, error) {
+	owner, err := getOwner(stub, name)
+	if err != nil {
+		return party{}, err
+	}
+	return party{owner.Name, aadharAttribute, strconv.FormatInt(owner.Aadhar, 10)}, nil
+}
+
+// newHolderOf : the holder named by registerEncumbrance
+func newHolderOf(stub shim.ChaincodeStubInterface, args []string) (party, error) {
+	if len(args) < 3 {
+		return party{}, errInvalidArgument("Holder not specified")
+	}
+	return party{args[2], holderAttribute, args[2]}, nil
+}
+
+// holderOf : the holder of the encumbrance named by survey number and
+// sequence number in the first two arguments
+func holderOf(stub shim.ChaincodeStubInterface, args []string) (party, error) {
+	if len(args) < 2 {
+		return party{}, errInvalidArgument("Encumbrance not specified")
+	}
+	surveyNo, err := parseSurveyNo(args[0])
+	if err != nil {
+		return party{}, err
+	}
+	seq, err := parseNonNegative("Encumbrance number", args[1])
+	if err != nil {
+		return party{}, err
+	}
+	encumbrance, err := getEncumbrance(stub, surveyNo, seq)
+	if err != nil {
+		return party{}, err
+	}
+	return party{encumbrance.Holder, holderAttribute, encumbrance.Holder}, nil
+}
+
+// sellerOfSale : the seller of the sale named by the first argument,
+// identified by the Aadhar number
+func sellerOfSale(stub shim.ChaincodeStubInterface, args []string) (party, error) {
+	if len(args) == 0 {
+		return party{}, errInvalidArgument("Sale not specified")
+	}
+	sale, err := getSale(stub, args[0])
+	if err != nil {
+		return party{}, err
+	}
+	return ownerParty(stub, sale.Seller)
+}
+
+// buyerOfSale : the buyer of the sale named by the first argument,
+// identified by the Aadhar number
+func buyerOfSale(stub shim.ChaincodeStubInterface, args []string) (party, error) {
+	if len(args) == 0 {
+		return party{}, errInvalidArgument("Sale not specified")
+	}
+	sale, err := getSale(stub, args[0])
+	if err != nil {
+		return party{}, err
+	}
+	return ownerParty(stub, sale.Buyer)
+}
+
+// partyOfSale : the buyer of the sale named by the first argument if the
+// caller holds the buyer's Aadhar number, otherwise the seller
+func partyOfSale(stub shim.ChaincodeStubInterface, args []string) (party, error) {
+	if len(args) == 0 {
+		return party{}, errInvalidArgument("Sale not specified")
+	}
+	sale, err := getSale(stub, args[0])
+	if err != nil {
+		return party{}, err
+	}
+	buyer, err := ownerParty(stub, sale.Buyer)
+	if err != nil {
+		return party{}, err
+	}
+	if isBuyer, err := stub.VerifyAttribute(buyer.attribute, []byte(buyer.value)); err == nil && isBuyer {
+		return buyer, nil
+	}
+	return ownerParty(stub, sale.Seller)
+}
+
+// authorize : checks the caller's certificate attributes against the policy
+// of a function
+func authorize(stub shim.ChaincodeStubInterface, function string, p policy, args []string) error {
+	role, err := stub.ReadCertAttribute(roleAttribute)
+	if err == nil {
+		for _, allowed := range p.roles {
+			if string(role) == allowed {
+				return nil
+			}
+		}
+	}
+
+	if p.party != nil {
+		pt, partyErr := p.party(stub, args)
+		if registryErr, ok := partyErr.(*RegistryError); ok && registryErr.Code == codeInvalidArgument {
+			return partyErr
+		}
+		if partyErr != nil {
+			return newRegistryError(codeAccessDenied, function, "Cannot establish the party: %s", errorMessage(partyErr))
+		}
+		isParty, verifyErr := stub.VerifyAttribute(pt.attribute, []byte(pt.value))
+		if verifyErr == nil && isParty {
+			return nil
+		}
+		if err != nil && verifyErr != nil {
+			return newRegistryError(codeUnauthenticated, function, "Caller certificate carries neither a role nor a %s attribute", pt.attribute)
+		}
+		return newRegistryError(codeAccessDenied, function, "Caller is not %s and not one of %v", pt.name, p.roles)
+	}
+
+	if err != nil {
+		return newRegistryError(codeUnauthenticated, function, "Caller certificate carries no role attribute")
+	}
+	return newRegistryError(codeAccessDenied, function, "Role %q may not call %s, expected one of %v", string(role), function, p.roles)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// maxBulkRecords bounds the number of properties bulkInitProperties
+// registers in a single transaction
+const maxBulkRecords = 1000
+
+// PropertyRecord struct is a property to register with bulkInitProperties,
+// and the arguments of initProperty. The numbers are kept as text so that
+// both report malformed numbers the same way.
+type PropertyRecord struct {
+	Name     string      `json:"name" arg:"name"`
+	Aadhar   json.Number `json:"aadhar" arg:"aadhar"`
+	SurveyNo json.Number `json:"surveyNo" arg:"surveyNo"`
+	Location string      `json:"location" arg:"location"`
+	Area     json.Number `json:"area" arg:"area"`
+}
+
+// RecordError struct reports why a record of a bulk import was rejected
+type RecordError struct {
+	Index   int    `json:"index"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ExportRecord struct is an owner or a survey in the export of the registry
+type ExportRecord struct {
+	Type   string  `json:"type"` // "owner" or "survey"
+	Owner  *Owner  `json:"owner,omitempty"`
+	Survey *Survey `json:"survey,omitempty"`
+}
+
+// ExportPage struct is the response of exportRegistry
+type ExportPage struct {
+	Records   []ExportRecord `json:"records"`
+	NextStart string         `json:"nextStart"`
+	HasMore   bool           `json:"hasMore"`
+}
+
+// propertyBatch collects validated properties to register, so that records
+// of one batch are checked against each other as well as against the state
+type propertyBatch struct {
+	owners    map[string]*Owner
+	newOwners []string // owners the batch registers, in order of appearance
+	oldOwners []string // registered owners the batch adds surveys to
+	aadhars   map[int64]string
+	surveys   []Survey
+}
+
+func newPropertyBatch() *propertyBatch {
+	return &propertyBatch{owners: make(map[string]*Owner), aadhars: make(map[int64]string)}
+}
+
+// add : validates a property and adds it to the batch
+func (b *propertyBatch) add(stub shim.ChaincodeStubInterface, record PropertyRecord) error {
+	ownerName := record.Name
+	if err := checkName("Owner name", ownerName); err != nil {
+		return err
+	}
+	aadhar, err := parseAadhar(record.Aadhar.String())
+	if err != nil {
+		return err
+	}
+	surveyNo, err := parseSurveyNo(record.SurveyNo.String())
+	if err != nil {
+		return err
+	}
+	if err = checkName("Location", record.Location); err != nil {
+		return err
+	}
+	area, err := parsePositive("Area", record.Area.String())
+	if err != nil {
+		return err
+	}
+
+	// The survey must be new to the state and the batch
+	_, surveyExists, err := findSurvey(stub, surveyNo)
+	if err != nil {
+		return err
+	}
+	for _, survey := range b.surveys {
+		if survey.SurveyNo == surveyNo {
+			surveyExists = true
+		}
+	}
+	if surveyExists {
+		return errAlreadyExists("Survey %d already exists", surveyNo)
+	}
+
+	// The owner is registered unless the state or the batch already has it
+	owner, ownerExists := b.owners[ownerName]
+	if !ownerExists {
+		found, exists, err := findOwner(stub, ownerName)
+		if err != nil {
+			return err
+		}
+		owner, ownerExists = &found, exists
+		if !exists {
+			owner.Name = ownerName
+			owner.Aadhar = aadhar
+		}
+	}
+	if ownerExists && owner.Aadhar != aadhar {
+		return errInvalidArgument("Owner %s is registered with another Aadhar number", ownerName)
+	}
+	if !ownerExists {
+		// An Aadhar number identifies a single owner
+		holder, taken := b.aadhars[aadhar]
+		if !taken {
+			holderAsBytes, err := stub.GetState(aadharKey(aadhar))
+			if err != nil {
+				return errInternal("Failed to get Aadhar index: %s", err)
+			}
+			holder, taken = string(holderAsBytes), holderAsBytes != nil
+		}
+		if taken {
+			return errAlreadyExists("Aadhar number %d is already registered to %s", aadhar, holder)
+		}
+	}
+
+	if _, seen := b.owners[ownerName]; !seen {
+		b.owners[ownerName] = owner
+		if ownerExists {
+			b.oldOwners = append(b.oldOwners, ownerName)
+		} else {
+			b.newOwners = append(b.newOwners, ownerName)
+			b.aadhars[aadhar] = ownerName
+		}
+	}
+	owner.SurveyNos = append(owner.SurveyNos, surveyNo)
+	b.surveys = append(b.surveys, Survey{
+		SurveyNo: surveyNo,
+		Area:     area,
+		Location: record.Location,
+		Owners:   []string{ownerName},
+		Shares:   map[string]int64{ownerName: fullShare},
+	})
+	return nil
+}
+
+// put : writes the owners and surveys of the batch with their index entries
+// and the opening record of every survey's history
+func (b *propertyBatch) put(stub shim.ChaincodeStubInterface) error {
+	for _, name := range b.oldOwners {
+		if err := putOwner(stub, *b.owners[name]); err != nil {
+			return err
+		}
+	}
+	for _, name := range b.newOwners {
+		owner := b.owners[name]
+		if err := putOwner(stub, *owner); err != nil {
+			return err
+		}
+		if err := stub.PutState(aadharKey(owner.Aadhar), []byte(name)); err != nil {
+			return errInternal("Failed to put Aadhar index: %s", err)
+		}
+	}
+	for _, survey := range b.surveys {
+		if err := putSurvey(stub, survey); err != nil {
+			return err
+		}
+		err := stub.PutState(locationKey(survey.Location, survey.SurveyNo), []byte(strconv.FormatInt(survey.SurveyNo, 10)))
+		if err != nil {
+			return errInternal("Failed to put location index: %s", err)
+		}
+		if err = appendTransferRecord(stub, survey.SurveyNo, "", survey.Owners[0], fullShare); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bulkInitProperties : registers many properties at once. Expects a JSON
+// array of PropertyRecord. Every record is validated first; if any is
+// rejected nothing is written and the error lists each rejected record. The
+// error has the code of the rejections when they all share one, and
+// RECORDS_REJECTED otherwise.
+func (t *SimpleChaincode) bulkInitProperties(stub shim.ChaincodeStubInterface, args bulkArgs) (int, error) {
+	records := args.Properties
+	if len(records) == 0 || len(records) > maxBulkRecords {
+		return 0, errInvalidArgument("Number of properties must be between 1 and %d", maxBulkRecords)
+	}
+
+	batch := newPropertyBatch()
+	var rejected []RecordError
+	for i, record := range records {
+		if err := batch.add(stub, record); err != nil {
+			recordErr := RecordError{Index: i, Code: codeInternal, Message: errorMessage(err)}
+			if registryErr, ok := err.(*RegistryError); ok {
+				recordErr.Code = registryErr.Code
+			}
+			rejected = append(rejected, recordErr)
+		}
+	}
+	if len(rejected) != 0 {
+		code := rejected[0].Code
+		for _, recordErr := range rejected {
+			if recordErr.Code != code {
+				code = codeRecordsRejected
+				break
+			}
+		}
+		registryErr := newRegistryError(code, "", "%d of %d properties rejected, none registered", len(rejected), len(records))
+		registryErr.Records = rejected
+		return 0, registryErr
+	}
+
+	if err := batch.put(stub); err != nil {
+		return 0, err
+	}
+
+	return len(records), nil
+}
+
+// bulkArgs : arguments of bulkInitProperties
+type bulkArgs struct {
+	Properties []PropertyRecord `arg:"properties"`
+}
+
+// exportRegistry : lists every owner, then every survey, in key order.
+// Expects optionally the nextStart of the previous page and the page size.
+func (t *SimpleChaincode) exportRegistry(stub shim.ChaincodeStubInterface, args pageArgs) (*ExportPage, error) {
+	limit, err := pageLimit(args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	start := args.Start
+	if start != "" && !strings.HasPrefix(start, ownerPrefix) && !strings.HasPrefix(start, surveyPrefix) {
+		return nil, errInvalidArgument("Start must be the nextStart of a previous page")
+	}
+
+	page := ExportPage{Records: []ExportRecord{}}
+	var next *kv
+
+	// Owners come first, the surveys fill the rest of the page
+	if !strings.HasPrefix(start, surveyPrefix) {
+		entries, more, err := scanPage(stub, ownerPrefix, strings.TrimPrefix(start, ownerPrefix), limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			owner := new(Owner)
+			if err = json.Unmarshal(entry.value, owner); err != nil {
+				return nil, errInternal("Failed to decode %s: %s", entry.key, err)
+			}
+			page.Records = append(page.Records, ExportRecord{Type: "owner", Owner: owner})
+		}
+		next = more
+		start = ""
+	}
+	if next == nil && len(page.Records) < limit {
+		entries, more, err := scanPage(stub, surveyPrefix, strings.TrimPrefix(start, surveyPrefix), limit-len(page.Records))
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			survey := new(Survey)
+			if err = json.Unmarshal(entry.value, survey); err != nil {
+				return nil, errInternal("Failed to decode %s: %s", entry.key, err)
+			}
+			normalizeShares(survey)
+			page.Records = append(page.Records, ExportRecord{Type: "survey", Survey: survey})
+		}
+		next = more
+	} else if next == nil {
+		// The owners filled the page exactly; resume with the surveys
+		entries, _, err := scanPage(stub, surveyPrefix, "", 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) != 0 {
+			next = &entries[0]
+		}
+	}
+	if next != nil {
+		page.NextStart = next.key
+		page.HasMore = true
+	}
+
+	return &page, nil
+}
@@ -2,22 +2,26 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io/ioutil"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
 
+// logger : logs of the chaincode, bound to each transaction with WithStub so
+// that the peer can tag them when log forwarding is enabled
+var logger = shim.NewLogger("registry")
+
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
+	// routers of the invoke and query functions, built on first use
+	once    sync.Once
+	invokes *shim.Router
+	queries *shim.Router
 }
 
-// For keeping track of all users and survey numbers
-var ownerIndexStr = "_ownerIndex"
-var surveyIndexStr = "_surveyIndex"
-
 // Owner struct stores owner specific details
 type Owner struct {
 	Name      string  `json:"name"`
@@ -27,181 +31,159 @@ type Owner struct {
 
 // Survey struct stores property specific details
 type Survey struct {
-	SurveyNo int64    `json:"surveyNo"`
-	Area     int64    `json:"area"`
-	Location string   `json:"location"`
-	Owners   []string `json:"owners"`
+	SurveyNo int64            `json:"surveyNo"`
+	Area     int64            `json:"area"`
+	Location string           `json:"location"`
+	Owners   []string         `json:"owners"`
+	Shares   map[string]int64 `json:"shares"` // percentage held by each owner, sums to fullShare
+
+	Encumbrances int64  `json:"encumbrances"` // number of active encumbrances
+	Escrow       string `json:"escrow"`       // ID of the accepted sale holding the survey
+
+	// Lineage of subdivided and merged surveys. A retired survey has been
+	// replaced by its children and can no longer change hands.
+	Retired  bool    `json:"retired"`
+	Parents  []int64 `json:"parents"`
+	Children []int64 `json:"children"`
+
+	// Active surveys a registrar recorded as sharing a boundary with this one
+	Adjacent []int64 `json:"adjacent"`
 }
 
-// Init : Adds initial block to chaincode on blockchain network
-func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	var Aval int
-	var err error
+// fullShare is the percentage held by a sole owner
+const fullShare int64 = 100
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 1")
-	}
+// Init : Adds initial block to chaincode on blockchain network
+func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string, args []string) (_ []byte, err error) {
+	defer func() { err = inFunction("init", err) }()
+	return t.invokeRouter().Route(stub, "init", args)
+}
 
-	// Initialize the chaincode
-	Aval, err = strconv.Atoi(args[0])
-	if err != nil {
-		return nil, errors.New("Expecting integer value for asset holding")
-	}
+// initArgs : arguments of init
+type initArgs struct {
+	Value int `arg:"value"`
+}
 
+// init : writes the initial value of abc
+func (t *SimpleChaincode) init(stub shim.ChaincodeStubInterface, args initArgs) error {
 	// Write the state to the ledger
-	err = stub.PutState("abc", []byte(strconv.Itoa(Aval))) //making a test var "abc", I find it handy to read/write to it right away to test the network
-	if err != nil {
-		return nil, err
-	}
-
-	// Initialize owner and survey index
-	var empty []string
-	jsonAsBytes, _ := json.Marshal(empty) //marshal an emtpy array of strings to clear the index
-	err = stub.PutState(ownerIndexStr, jsonAsBytes)
+	err := stub.PutState("abc", []byte(strconv.Itoa(args.Value))) //making a test var "abc", I find it handy to read/write to it right away to test the network
 	if err != nil {
-		return nil, errors.New("Error initializing owner index")
+		return errInternal("Failed to put abc: %s", err)
 	}
-
-	var emptySurvey []int64
-	jsonAsBytes, _ = json.Marshal(emptySurvey) //marshal an emtpy array of int64 to clear the index
-	err = stub.PutState(surveyIndexStr, jsonAsBytes)
-	if err != nil {
-		return nil, errors.New("Error initializing survey index")
-	}
-
-	return nil, nil
+	return nil
 }
 
 // Run : Entry point for all the Invoke functions
 func (t *SimpleChaincode) Run(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("run is running " + function)
+	logger.WithStub(stub).Info("run is running " + function)
 	return t.Invoke(stub, function, args)
 }
 
 // Invoke : Adds a new block to the blockchain network
-func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	if function == "init" {
-		// Initial block - Puts 'abc' and '99'
-		return t.Init(stub, "init", args)
-	} else if function == "initProperty" {
-		// Pushes property details to Blockchain network
-		return t.initProperty(stub, args)
-	} else if function == "transfer" {
-		// Transfers property from one owner to another
-		return t.transfer(stub, args)
-	} else if function == "debug" {
-		// only fot testing transfer function
-		return t.debug(stub, args)
+func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) (_ []byte, err error) {
+	// Every error reaches the client as a RegistryError naming the function
+	defer func() { err = inFunction(function, err) }()
+
+	// Check the caller may run the function before dispatching it
+	p, ok := invokePolicies[function]
+	if !ok {
+		logger.WithStub(stub).Warning("invoke did not find policy for func: " + function)
+		return nil, newRegistryError(codeUnknownFunction, function, "Received unknown function invocation")
+	}
+	if err = authorize(stub, function, p, args); err != nil {
+		return nil, err
 	}
 
-	fmt.Println("invoke did not find func: " + function) //error
-
-	return nil, errors.New("Received unknown function invocation")
+	return t.invokeRouter().Route(stub, function, args)
 }
 
-// initProperty : Registers a new property
-func (t *SimpleChaincode) initProperty(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+// invokeRouter : the router of the invoke functions
+func (t *SimpleChaincode) invokeRouter() *shim.Router {
+	t.once.Do(t.buildRouters)
+	return t.invokes
+}
 
-	if len(args) != 5 {
-		return nil, errors.New("Incorrect number of arguments. Expected 5 arguments")
-	}
+// queryRouter : the router of the query functions
+func (t *SimpleChaincode) queryRouter() *shim.Router {
+	t.once.Do(t.buildRouters)
+	return t.queries
+}
 
-	fmt.Println("- start init property")
+// buildRouters : registers the handler of every function. Every function
+// routed must have a policy in invokePolicies or queryPolicies.
+func (t *SimpleChaincode) buildRouters() {
+	t.invokes = shim.NewRouter().
+		// Initial block - Puts 'abc' and '99'
+		Handle("init", t.init).
+		// Pushes property details to Blockchain network
+		Handle("initProperty", t.initProperty).
+		// Pushes many property details to Blockchain network at once
+		Handle("bulkInitProperties", t.bulkInitProperties).
+		// Transfers property from one owner to another
+		Handle("transfer", t.transfer).
+		// Registers a mortgage, lien or court stay against a property
+		Handle("registerEncumbrance", t.registerEncumbrance).
+		// Discharges an encumbrance
+		Handle("releaseEncumbrance", t.releaseEncumbrance).
+		// Encumbrance holder allows a transfer of the property
+		Handle("consentTransfer", t.consentTransfer).
+		// Splits a property into child surveys
+		Handle("subdivideSurvey", t.subdivideSurvey).
+		// Combines properties into a new survey
+		Handle("mergeSurveys", t.mergeSurveys).
+		// Records that two properties share a boundary
+		Handle("recordAdjacency", t.recordAdjacency).
+		// Seller offers a property to a buyer at a price
+		Handle("proposeSale", t.proposeSale).
+		// Buyer accepts a sale, putting the property in escrow
+		Handle("acceptSale", t.acceptSale).
+		// Registrar approves an accepted sale
+		Handle("approveSale", t.approveSale).
+		// Transfers the property of an approved sale
+		Handle("finalizeSale", t.finalizeSale).
+		// Withdraws a sale, releasing the escrow
+		Handle("cancelSale", t.cancelSale).
+		// Moves the records of an older deployment to the prefixed keys
+		Handle("migrateLegacyKeys", t.migrateLegacyKeys)
+
+	t.queries = shim.NewRouter().
+		Handle("readInit", t.readInit).                           // read init (key: 'abc') value, used for tracking pre-flight check
+		Handle("readOwner", t.readOwner).                         // read a owner's details
+		Handle("readSurvey", t.readSurvey).                       // read survey details
+		Handle("readOwnerIndex", t.readOwnerIndex).               // retrieve all owners
+		Handle("readSurveyIndex", t.readSurveyIndex).             // retrieve all survey details
+		Handle("readSurveyHistory", t.readSurveyHistory).         // retrieve the title chain of a survey
+		Handle("readSurveyAsOf", t.readSurveyAsOf).               // read survey details as of a block
+		Handle("readSurveyVersions", t.readSurveyVersions).       // retrieve the committed versions of a survey
+		Handle("readSurveysByLocation", t.readSurveysByLocation). // retrieve survey details of a location
+		Handle("readOwnerByAadhar", t.readOwnerByAadhar).         // read a owner's details by Aadhar number
+		Handle("readEncumbrances", t.readEncumbrances).           // retrieve encumbrances of a survey
+		Handle("readSale", t.readSale).                           // read a sale agreement
+		Handle("readPendingSales", t.readPendingSales).           // retrieve the open sales of a seller or buyer
+		Handle("readExpiredSales", t.readExpiredSales).           // retrieve the expired sales of a seller or buyer left to cancel
+		Handle("simulateTransfer", t.simulateTransfer).           // dry run of a transfer
+		Handle("exportRegistry", t.exportRegistry)                // retrieve all owners and surveys for reconciliation
+}
 
-	var owner Owner
-	var survey Survey
-	var err error
-
-	// Setting keys
-	var ownerName = args[0]
-	owner.Name = ownerName
-	var surveyNumber int64
-	surveyNumber, _ = strconv.ParseInt(args[2], 10, 64)
-	survey.SurveyNo = surveyNumber
-
-	// Get owner's state from blockchain network
-	valAsBytes, _ := stub.GetState(args[0])
-
-	// Unmarshalling the owner's state
-	var retrieveSurveyNos Owner
-	json.Unmarshal(valAsBytes, &retrieveSurveyNos)
-
-	// Setting the owner object
-	if retrieveSurveyNos.Aadhar == 0 {
-		owner.Aadhar, _ = strconv.ParseInt(args[1], 10, 64)
-		owner.SurveyNos = append(owner.SurveyNos, surveyNumber)
-	} else {
-		owner.Aadhar = retrieveSurveyNos.Aadhar
-		owner.SurveyNos = append(retrieveSurveyNos.SurveyNos, surveyNumber)
-	}
-
-	// Get the survey state from blockchain network
-	surveyAsBytes, _ := stub.GetState(args[2])
-
-	// Unmarshalling the survey object
-	var retrieveSurvey Survey
-	json.Unmarshal(surveyAsBytes, &retrieveSurvey)
-
-	// Setting the survey object
-	if retrieveSurvey.Area == 0 {
-		survey.Location = args[3]
-		survey.Area, _ = strconv.ParseInt(args[4], 10, 64)
-		survey.Owners = append(survey.Owners, ownerName)
-	} else {
-		return nil, errors.New("Property already exists")
-	}
-
-	// Marshalling the owner object
-	bytes, _ := json.Marshal(owner)
-	err = stub.PutState(ownerName, bytes)
-	if err != nil {
-		return nil, errors.New("Putstate failed")
-	}
-
-	// Adding owner to ownerIndex
-	ownerIndexAsBytes, _ := stub.GetState(ownerIndexStr)
-	var ownerIndex []string
-	json.Unmarshal(ownerIndexAsBytes, &ownerIndex)
-	flag := true
-	if len(ownerIndex) == 0 {
-		ownerIndex = append(ownerIndex, ownerName)
-		flag = false
-	} else {
-		for i := 0; i < len(ownerIndex); i++ {
-			if ownerIndex[i] == ownerName {
-				flag = false
-			}
-		}
-	}
-	if flag {
-		ownerIndex = append(ownerIndex, ownerName)
-	}
-	bytesOwnerIndex, _ := json.Marshal(ownerIndex)
-	err = stub.PutState(ownerIndexStr, bytesOwnerIndex)
-	if err != nil {
-		return nil, errors.New("Putstate failed")
-	}
+// initProperty : Registers a new property. Expects owner name, Aadhar
+// number, survey number, location and area.
+func (t *SimpleChaincode) initProperty(stub shim.ChaincodeStubInterface, record PropertyRecord) error {
+	logger.WithStub(stub).Debugf("- start init property %s", record.SurveyNo)
 
-	// Marshalling the survey object
-	bytesSurvey, _ := json.Marshal(survey)
-	err = stub.PutState(args[2], bytesSurvey)
-	if err != nil {
-		return nil, errors.New("Putstate failed")
+	// Validate the property against the state before touching it
+	batch := newPropertyBatch()
+	if err := batch.add(stub, record); err != nil {
+		return err
 	}
 
-	// Adding survey to surveyIndex
-	surveyIndexAsBytes, _ := stub.GetState(surveyIndexStr)
-	var surveyIndex []int64
-	json.Unmarshal(surveyIndexAsBytes, &surveyIndex)
-	surveyIndex = append(surveyIndex, surveyNumber)
-	bytesSurveyIndex, _ := json.Marshal(surveyIndex)
-	err = stub.PutState(surveyIndexStr, bytesSurveyIndex)
-	if err != nil {
-		return nil, errors.New("Putstate failed")
+	// Put the owner, the survey, their index entries and history
+	if err := batch.put(stub); err != nil {
+		return err
 	}
 
-	fmt.Println("- end init property")
-	return nil, nil
+	logger.WithStub(stub).Debugf("- end init property %s", record.SurveyNo)
+	return nil
 }
 
 // SliceIndex : find the index of an element in an array (generic)
@@ -214,251 +196,511 @@ func SliceIndex(limit int, predicate func(i int) bool) int {
 	return -1
 }
 
-// Debug : testing trasnfer function operations individually
-func (t *SimpleChaincode) debug(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	transferSurvey, _ := strconv.ParseInt(args[1], 10, 64)
-
-	// 1. Remove survey number from seller (owner struct)
-	sellerAsBytes, _ := stub.GetState(args[0])
-	var sellerObj Owner
-	var newSellerObj Owner
-	json.Unmarshal(sellerAsBytes, &sellerObj)
+// Transfer : transfers a property, or a share of it, from one owner to another.
+// Expects seller, survey number, buyer and optionally the percentage to move;
+// without it the seller's whole share is transferred. Everything is validated
+// before the first PutState, so a rejected transfer leaves the state untouched.
+func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, args transferArgs) error {
+	pending, err := args.prepare(stub)
+	if err != nil {
+		return err
+	}
+	return pending.commit(stub)
+}
 
-	newSellerObj.Name = sellerObj.Name
-	newSellerObj.Aadhar = sellerObj.Aadhar
+// simulateTransfer : dry run of a transfer. Expects the arguments of transfer
+// and returns the seller, buyer and survey as the transfer would leave them,
+// without writing anything.
+func (t *SimpleChaincode) simulateTransfer(stub shim.ChaincodeStubInterface, args transferArgs) (*TransferSimulation, error) {
+	pending, err := args.prepare(stub)
+	if err != nil {
+		return nil, err
+	}
 
-	index := SliceIndex(len(sellerObj.SurveyNos), func(i int) bool { return sellerObj.SurveyNos[i] == transferSurvey })
-	newSellerObj.SurveyNos = append(sellerObj.SurveyNos[:index], sellerObj.SurveyNos[index+1:]...)
+	return &TransferSimulation{
+		Seller:       pending.seller,
+		Buyer:        pending.buyer,
+		Survey:       pending.survey,
+		Share:        pending.share,
+		Encumbrances: pending.encumbrances,
+	}, nil
+}
 
-	sellerBytes, _ := json.Marshal(newSellerObj)
-	_ = ioutil.WriteFile("output.json", sellerBytes, 0644)
-	_ = stub.PutState(args[0], sellerBytes)
+// TransferSimulation struct is the response of simulateTransfer
+type TransferSimulation struct {
+	Seller       Owner         `json:"seller"`
+	Buyer        Owner         `json:"buyer"`
+	Survey       Survey        `json:"survey"`
+	Share        int64         `json:"share"`
+	Encumbrances []Encumbrance `json:"encumbrances"` // encumbrances whose consent the transfer spends
+}
 
-	// 2. Add survey number to buyer's survey number array
-	buyerAsBytes, _ := stub.GetState(args[2])
-	var buyerObj Owner
-	var newBuyerObj Owner
-	json.Unmarshal(buyerAsBytes, &buyerObj)
+// transferArgs : arguments of transfer and simulateTransfer. Without a share
+// the seller's whole share is transferred.
+type transferArgs struct {
+	Seller   string `arg:"seller"`
+	SurveyNo int64  `arg:"surveyNo"`
+	Buyer    string `arg:"buyer"`
+	Share    *int64 `arg:"share,optional"`
+}
 
-	newBuyerObj.Name = buyerObj.Name
-	newBuyerObj.Aadhar = buyerObj.Aadhar
+// prepare : validates the arguments and prepares the transfer they describe
+func (args transferArgs) prepare(stub shim.ChaincodeStubInterface) (*pendingTransfer, error) {
+	if err := checkSurveyNo(args.SurveyNo); err != nil {
+		return nil, err
+	}
+	var share int64
+	if args.Share != nil {
+		share = *args.Share
+		if err := checkPositive("Share", share); err != nil {
+			return nil, err
+		}
+	}
+	return prepareTransfer(stub, args.Seller, args.SurveyNo, args.Buyer, share, "")
+}
 
-	newBuyerObj.SurveyNos = append(buyerObj.SurveyNos, transferSurvey)
+// pendingTransfer holds the states a validated transfer will write
+type pendingTransfer struct {
+	seller       Owner
+	buyer        Owner
+	survey       Survey
+	share        int64
+	encumbrances []Encumbrance
+}
 
-	buyerBytes, _ := json.Marshal(newBuyerObj)
-	_ = ioutil.WriteFile("output1.json", buyerBytes, 0644)
-	_ = stub.PutState(args[2], buyerBytes)
+// prepareTransfer : validates a transfer of share percent of a survey, or of
+// the seller's whole share if it is 0, and computes the resulting states
+// without writing anything. A survey held in escrow only moves by the sale
+// holding it, named by saleID.
+func prepareTransfer(stub shim.ChaincodeStubInterface, sellerName string, transferSurveyNo int64, buyerName string, share int64, saleID string) (*pendingTransfer, error) {
+	if sellerName == buyerName {
+		return nil, errInvalidArgument("Seller and buyer must be different owners")
+	}
 
-	// 3. Add buyer's name to survey state
-	surveyAsBytes, _ := stub.GetState(args[1])
-	var surveyObj Survey
-	var newSurveyObj Survey
-	json.Unmarshal(surveyAsBytes, &surveyObj)
+	// 1. Fetch and validate seller, buyer and survey
 
-	newSurveyObj.Area = surveyObj.Area
-	newSurveyObj.Location = surveyObj.Location
-	newSurveyObj.SurveyNo = surveyObj.SurveyNo
+	sellerObj, err := getOwner(stub, sellerName)
+	if err != nil {
+		return nil, err
+	}
+	buyerObj, err := getOwner(stub, buyerName)
+	if err != nil {
+		return nil, err
+	}
+	survey, err := getActiveSurvey(stub, transferSurveyNo)
+	if err != nil {
+		return nil, err
+	}
+	if survey.Escrow != saleID {
+		return nil, errFailedPrecondition("Survey %d is held in escrow by sale %s", transferSurveyNo, survey.Escrow)
+	}
 
-	newSurveyObj.Owners = append(surveyObj.Owners, args[2])
+	sellerShare := survey.Shares[sellerName]
+	if sellerShare == 0 || indexOfSurveyNo(sellerObj.SurveyNos, transferSurveyNo) == -1 {
+		return nil, errFailedPrecondition("%s does not own survey %d", sellerName, transferSurveyNo)
+	}
 
-	surveyBytes, _ := json.Marshal(newSurveyObj)
-	_ = ioutil.WriteFile("output2.json", surveyBytes, 0644)
-	_ = stub.PutState(args[1], surveyBytes)
-	return nil, nil
-}
+	if share == 0 {
+		share = sellerShare
+	}
+	if share < 0 || share > sellerShare {
+		return nil, errInvalidArgument("Share must be between 1 and %d, the seller's share of survey %d", sellerShare, transferSurveyNo)
+	}
 
-// Transfer : transfers property from one owner to another
-func (t *SimpleChaincode) transfer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	if len(args) != 3 {
-		return nil, errors.New("Incorrect number of arguments. Expected 3 arguments")
+	// An encumbered survey only moves with the consent of every holder
+	encumbrances, err := checkEncumbrances(stub, survey, buyerName)
+	if err != nil {
+		return nil, err
 	}
 
-	// Set keys
-	sellerName := args[0]
-	buyerName := args[2]
-	transferSurveyNo, _ := strconv.ParseInt(args[1], 10, 64)
+	// 2. Move the share on the survey and update both owners' survey numbers
 
-	// 1. Remove survey number from seller (owner struct)
+	if survey.Shares[buyerName] == 0 {
+		survey.Owners = append(survey.Owners, buyerName)
+	}
+	if indexOfSurveyNo(buyerObj.SurveyNos, transferSurveyNo) == -1 {
+		buyerObj.SurveyNos = append(buyerObj.SurveyNos, transferSurveyNo)
+	}
+	survey.Shares[buyerName] += share
+	survey.Shares[sellerName] -= share
 
-	// Fetch seller and unmarshall the result
-	sellerAsBytes, _ := stub.GetState(sellerName)
-	var sellerObj Owner
-	json.Unmarshal(sellerAsBytes, &sellerObj)
+	if survey.Shares[sellerName] == 0 {
+		delete(survey.Shares, sellerName)
+		survey.Owners = removeOwnerName(survey.Owners, sellerName)
+		sellerObj.SurveyNos = removeSurveyNo(sellerObj.SurveyNos, transferSurveyNo)
+	}
 
-	// Remove survey number from seller's survey number array
-	var newSellerObj Owner
-	newSellerObj.Name = sellerObj.Name
-	newSellerObj.Aadhar = sellerObj.Aadhar
-	index := SliceIndex(len(sellerObj.SurveyNos), func(i int) bool { return sellerObj.SurveyNos[i] == transferSurveyNo })
-	if index != -1 {
-		newSellerObj.SurveyNos = append(sellerObj.SurveyNos[:index], sellerObj.SurveyNos[index+1:]...)
-	} else {
-		err := errors.New("An error occured")
-		return nil, err
+	return &pendingTransfer{sellerObj, buyerObj, survey, share, encumbrances}, nil
+}
+
+// commit : puts the new states of seller, buyer and survey into blockchain
+// and records the change of hands in the survey's history
+func (p *pendingTransfer) commit(stub shim.ChaincodeStubInterface) error {
+	if err := putOwner(stub, p.seller); err != nil {
+		return err
+	}
+	if err := putOwner(stub, p.buyer); err != nil {
+		return err
+	}
+	if err := putSurvey(stub, p.survey); err != nil {
+		return err
+	}
+	for _, encumbrance := range p.encumbrances {
+		// Consents are spent by the transfer they allowed
+		if err := putEncumbrance(stub, encumbrance); err != nil {
+			return err
+		}
 	}
 
-	// Put the new state of seller into blockchain
-	sellerAsBytes, _ = json.Marshal(newSellerObj)
-	_ = stub.PutState(sellerName, sellerAsBytes)
+	return appendTransferRecord(stub, p.survey.SurveyNo, p.seller.Name, p.buyer.Name, p.share)
+}
 
-	// 2. Add survey number to buyer's survey number array
+// getOwner : fetches an owner, failing if it has not been registered
+func getOwner(stub shim.ChaincodeStubInterface, name string) (Owner, error) {
+	owner, exists, err := findOwner(stub, name)
+	if err == nil && !exists {
+		err = errNotFound("Owner %s doesn't exist", name)
+	}
+	return owner, err
+}
 
-	// Fetch buyer and unmarshall the result
-	buyerAsBytes, _ := stub.GetState(buyerName)
-	var buyerObj Owner
-	json.Unmarshal(buyerAsBytes, &buyerObj)
+// findOwner : fetches an owner and whether it has been registered
+func findOwner(stub shim.ChaincodeStubInterface, name string) (Owner, bool, error) {
+	var owner Owner
+	ownerAsBytes, err := stub.GetState(ownerKey(name))
+	if err != nil {
+		return owner, false, errInternal("Failed to get owner %s: %s", name, err)
+	}
+	if ownerAsBytes == nil {
+		return owner, false, nil
+	}
+	if err = json.Unmarshal(ownerAsBytes, &owner); err != nil {
+		return owner, false, errInternal("Failed to decode owner %s: %s", name, err)
+	}
+	return owner, true, nil
+}
 
-	// Appending survey number to buyer's survey number array
-	buyerObj.SurveyNos = append(buyerObj.SurveyNos, transferSurveyNo)
+// getSurvey : fetches a survey, failing if it has not been registered
+func getSurvey(stub shim.ChaincodeStubInterface, surveyNo int64) (Survey, error) {
+	survey, exists, err := findSurvey(stub, surveyNo)
+	if err == nil && !exists {
+		err = errNotFound("Survey number %d doesn't exist", surveyNo)
+	}
+	return survey, err
+}
 
-	// Put the new state of buyer into blockchain
-	buyerAsBytes, _ = json.Marshal(buyerObj)
-	_ = stub.PutState(buyerName, buyerAsBytes)
+// getSurveys : fetches several surveys in one round trip, failing if any has
+// not been registered
+func getSurveys(stub shim.ChaincodeStubInterface, surveyNos []int64) ([]Survey, error) {
+	keys := make([]string, len(surveyNos))
+	for i, surveyNo := range surveyNos {
+		keys[i] = surveyKey(surveyNo)
+	}
+	values, err := stub.GetStateMultiple(keys)
+	if err != nil {
+		return nil, errInternal("Failed to get surveys: %s", err)
+	}
 
-	// 3. Add buyer's name to survey state
+	surveys := make([]Survey, len(surveyNos))
+	for i, surveyNo := range surveyNos {
+		if values[i] == nil {
+			return nil, errNotFound("Survey number %d doesn't exist", surveyNo)
+		}
+		decoded, err := decodeSurvey(surveyNo, values[i])
+		if err != nil {
+			return nil, err
+		}
+		surveys[i] = *decoded
+	}
+	return surveys, nil
+}
 
-	// Fetch the survey state and unmarshall the result
-	surveyAsBytes, _ := stub.GetState(strconv.FormatInt(transferSurveyNo, 10))
+// findSurvey : fetches a survey and whether it has been registered
+func findSurvey(stub shim.ChaincodeStubInterface, surveyNo int64) (Survey, bool, error) {
 	var survey Survey
-	json.Unmarshal(surveyAsBytes, &survey)
+	surveyAsBytes, err := stub.GetState(surveyKey(surveyNo))
+	if err != nil {
+		return survey, false, errInternal("Failed to get survey %d: %s", surveyNo, err)
+	}
+	if surveyAsBytes == nil {
+		return survey, false, nil
+	}
+	decoded, err := decodeSurvey(surveyNo, surveyAsBytes)
+	if err != nil {
+		return survey, false, err
+	}
+	return *decoded, true, nil
+}
 
-	// Appending buyer's name to survey struct's owner array
-	survey.Owners = append(survey.Owners, buyerName)
+// putOwner : writes an owner under its owner key
+func putOwner(stub shim.ChaincodeStubInterface, owner Owner) error {
+	bytes, err := json.Marshal(owner)
+	if err != nil {
+		return errInternal("Failed to encode owner %s: %s", owner.Name, err)
+	}
+	if err = stub.PutState(ownerKey(owner.Name), bytes); err != nil {
+		return errInternal("Failed to put owner %s: %s", owner.Name, err)
+	}
+	return nil
+}
 
-	// Put the new state of survey into blockchain
-	surveyAsBytes, _ = json.Marshal(survey)
-	_ = stub.PutState(strconv.FormatInt(transferSurveyNo, 10), surveyAsBytes)
+// putSurvey : writes a survey under its survey key
+func putSurvey(stub shim.ChaincodeStubInterface, survey Survey) error {
+	bytes, err := json.Marshal(survey)
+	if err != nil {
+		return errInternal("Failed to encode survey %d: %s", survey.SurveyNo, err)
+	}
+	if err = stub.PutState(surveyKey(survey.SurveyNo), bytes); err != nil {
+		return errInternal("Failed to put survey %d: %s", survey.SurveyNo, err)
+	}
+	return nil
+}
 
-	return nil, nil
+// normalizeShares : fills in shares for surveys written before co-ownership
+// was tracked. The listed owners, without duplicates, split the property
+// equally and the first owner takes any remainder.
+func normalizeShares(survey *Survey) {
+	if len(survey.Shares) != 0 || len(survey.Owners) == 0 {
+		return
+	}
+	var owners []string
+	for _, name := range survey.Owners {
+		if SliceIndex(len(owners), func(i int) bool { return owners[i] == name }) == -1 {
+			owners = append(owners, name)
+		}
+	}
+	survey.Owners = owners
+	survey.Shares = make(map[string]int64)
+	each := fullShare / int64(len(owners))
+	for _, name := range owners {
+		survey.Shares[name] = each
+	}
+	survey.Shares[owners[0]] += fullShare - each*int64(len(owners))
 }
 
-// Query callback representing the query of a chaincode
-func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
+// indexOfSurveyNo : position of a survey number in a list, -1 if absent
+func indexOfSurveyNo(surveyNos []int64, surveyNo int64) int {
+	return SliceIndex(len(surveyNos), func(i int) bool { return surveyNos[i] == surveyNo })
+}
 
-	// Handle different functions
-	if function == "readInit" { // read init (key: 'abc') value, used for tracking pre-flight check
-		return t.readInit(stub, args)
-	} else if function == "readOwner" { // read a owner's details
-		return t.readOwner(stub, args)
-	} else if function == "readSurvey" { // read survey details
-		return t.readSurvey(stub, args)
-	} else if function == "readOwnerIndex" { // retrieve all owners
-		return t.readOwnerIndex(stub, args)
-	} else if function == "readSurveyIndex" { // retrieve all survey details
-		return t.readSurveyIndex(stub, args)
+// removeSurveyNo : removes the first occurrence of a survey number
+func removeSurveyNo(surveyNos []int64, surveyNo int64) []int64 {
+	index := indexOfSurveyNo(surveyNos, surveyNo)
+	if index == -1 {
+		return surveyNos
 	}
-	fmt.Println("query did not find func: " + function) //error
-
-	return nil, errors.New("Received unknown function query - Team PSL")
+	return append(surveyNos[:index], surveyNos[index+1:]...)
 }
 
-// readInit - used for reading init value, i.e 'abc' and '99'
-func (t *SimpleChaincode) readInit(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var err error
+// removeOwnerName : removes the first occurrence of an owner name
+func removeOwnerName(names []string, name string) []string {
+	index := SliceIndex(len(names), func(i int) bool { return names[i] == name })
+	if index == -1 {
+		return names
+	}
+	return append(names[:index], names[index+1:]...)
+}
 
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments")
+// Query callback representing the query of a chaincode
+func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) (_ []byte, err error) {
+	logger.WithStub(stub).Info("query is running " + function)
+	defer func() { err = inFunction(function, err) }()
+
+	// Check the caller may run the query before dispatching it
+	p, ok := queryPolicies[function]
+	if !ok {
+		logger.WithStub(stub).Warning("query did not find policy for func: " + function)
+		return nil, newRegistryError(codeUnknownFunction, function, "Received unknown function query - Team PSL")
+	}
+	if err = authorize(stub, function, p, args); err != nil {
+		return nil, err
 	}
 
-	valAsBytes, err := stub.GetState(args[0])
+	return t.queryRouter().Route(stub, function, args)
+}
+
+// readInit - used for reading init value, i.e 'abc' and '99'
+func (t *SimpleChaincode) readInit(stub shim.ChaincodeStubInterface, args keyArgs) ([]byte, error) {
+	valAsBytes, err := stub.GetState(args.Key)
 	if err != nil {
-		return nil, errors.New("Couldn't find init value, Please pass correct key")
+		return nil, errInternal("Failed to get %s: %s", args.Key, err)
+	}
+	if valAsBytes == nil {
+		return nil, errNotFound("Couldn't find init value, Please pass correct key")
 	}
 
 	return valAsBytes, nil
 }
 
-// read a owner's details
-func (t *SimpleChaincode) readOwner(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	if len(args) != 1 {
-		return nil, errors.New("Invalid numbers of arguments. Expected ")
-	}
+// keyArgs : arguments of readInit
+type keyArgs struct {
+	Key string `arg:"key"`
+}
 
-	var owner Owner
+// ownerArgs : arguments naming an owner
+type ownerArgs struct {
+	Name string `arg:"name"`
+}
 
-	// Get owner's details from chaincode state
-	valAsBytes, _ := stub.GetState(args[0])
-	// Unmarshalling the owner's details
-	json.Unmarshal(valAsBytes, &owner)
+// aadharArgs : arguments of readOwnerByAadhar. The Aadhar number is read as
+// text to check its digits.
+type aadharArgs struct {
+	Aadhar string `arg:"aadhar"`
+}
 
-	if owner.Aadhar == 0 {
-		return nil, errors.New("Owner doesn't exist")
+// read a owner's details
+func (t *SimpleChaincode) readOwner(stub shim.ChaincodeStubInterface, args ownerArgs) (*Owner, error) {
+	// Get owner's details from chaincode state
+	owner, err := getOwner(stub, args.Name)
+	if err != nil {
+		return nil, err
 	}
 
-	//Marshalling the owner object
-	bytes, _ := json.Marshal(owner)
-	a := []byte("'")
-	str := append(a, bytes...)
-	str = append(str, a...)
-	return []byte(str), nil // returns JSON of owner's details
+	return &owner, nil // returns JSON of owner's details
 }
 
 // read a survey details
-func (t *SimpleChaincode) readSurvey(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	if len(args) != 1 {
-		return nil, errors.New("Invalid numbers of arguments. Expected ")
+func (t *SimpleChaincode) readSurvey(stub shim.ChaincodeStubInterface, args surveyArgs) (*Survey, error) {
+	if err := checkSurveyNo(args.SurveyNo); err != nil {
+		return nil, err
 	}
 
-	var survey Survey
 	// Get survey details from chaincode state
-	valAsBytes, _ := stub.GetState(args[0])
-	// Unmarshalling the owner's details
-	json.Unmarshal(valAsBytes, &survey)
-
-	if survey.Area == 0 {
-		return nil, errors.New("Survey number doesn't exist")
+	survey, err := getSurvey(stub, args.SurveyNo)
+	if err != nil {
+		return nil, err
 	}
 
-	//Marshalling the survey object
-	bytes, _ := json.Marshal(survey)
-	a := []byte("'")
-	str := append(a, bytes...)
-	str = append(str, a...)
-	return []byte(str), nil // returns JSON of survey details
+	return &survey, nil // returns JSON of survey details
 }
 
-// fetch entire details of owners on blockchain network
-func (t *SimpleChaincode) readOwnerIndex(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	// Retrieve all owner names as bytes
-	ownerListAsBytes, _ := stub.GetState(ownerIndexStr)
-	var ownerList []string
-	json.Unmarshal(ownerListAsBytes, &ownerList)
+// readOwnerIndex : lists owners by name. Expects optionally the name to
+// start from and the page size.
+func (t *SimpleChaincode) readOwnerIndex(stub shim.ChaincodeStubInterface, args pageArgs) (*OwnerPage, error) {
+	limit, err := pageLimit(args.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, next, err := scanPage(stub, ownerPrefix, args.Start, limit)
+	if err != nil {
+		return nil, err
+	}
 
-	// fetch all owner details
-	var owners []Owner
-	for i := 0; i < len(ownerList); i++ {
-		bytesOwners, _ := stub.GetState(ownerList[i])
+	page := OwnerPage{Owners: []Owner{}}
+	for _, entry := range entries {
 		var owner Owner
-		json.Unmarshal(bytesOwners, &owner)
-		owners = append(owners, owner)
+		if err = json.Unmarshal(entry.value, &owner); err != nil {
+			return nil, errInternal("Failed to decode %s: %s", entry.key, err)
+		}
+		page.Owners = append(page.Owners, owner)
+	}
+	if next != nil {
+		page.NextStart = strings.TrimPrefix(next.key, ownerPrefix)
+		page.HasMore = true
 	}
 
-	// Marshalling and appending ''
-	bytes, _ := json.Marshal(owners)
-	return []byte(bytes), nil // returns JSON of entire owners on network
+	return &page, nil
 }
 
-// fetch entire details of survey numbers on blockchain network
-func (t *SimpleChaincode) readSurveyIndex(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	// Retrieve all survey numbers as bytes
-	surveyListAsBytes, _ := stub.GetState(surveyIndexStr)
-	var surveyList []int64
-	json.Unmarshal(surveyListAsBytes, &surveyList)
+// readSurveyIndex : lists active surveys by survey number. Expects optionally
+// the survey number to start from and the page size. Retired surveys are left
+// out of the page, which may then hold fewer surveys than the page size.
+func (t *SimpleChaincode) readSurveyIndex(stub shim.ChaincodeStubInterface, args pageArgs) (*SurveyPage, error) {
+	limit, err := pageLimit(args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	start, err := surveyStart(args.Start)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, next, err := scanPage(stub, surveyPrefix, start, limit)
+	if err != nil {
+		return nil, err
+	}
 
-	// fetch all survey details
-	var surveys []Survey
-	for i := 0; i < len(surveyList); i++ {
-		arg := strconv.FormatInt(surveyList[i], 10)
-		bytesSurvey, _ := stub.GetState(arg)
+	page := SurveyPage{Surveys: []Survey{}}
+	for _, entry := range entries {
 		var survey Survey
-		json.Unmarshal(bytesSurvey, &survey)
-		surveys = append(surveys, survey)
+		if err = json.Unmarshal(entry.value, &survey); err != nil {
+			return nil, errInternal("Failed to decode %s: %s", entry.key, err)
+		}
+		if survey.Retired {
+			continue
+		}
+		normalizeShares(&survey)
+		page.Surveys = append(page.Surveys, survey)
+	}
+	if next != nil {
+		page.NextStart = strconv.FormatInt(surveyNoOfKey(next.key, surveyPrefix), 10)
+		page.HasMore = true
+	}
+
+	return &page, nil
+}
+
+// readSurveysByLocation : lists the surveys of a location by survey number.
+// Expects the location and optionally the survey number to start from and
+// the page size.
+func (t *SimpleChaincode) readSurveysByLocation(stub shim.ChaincodeStubInterface, args locationPageArgs) (*SurveyPage, error) {
+	if err := checkName("Location", args.Location); err != nil {
+		return nil, err
+	}
+	limit, err := pageLimit(args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	start, err := surveyStart(args.Start)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := locationPrefix + args.Location + keySeparator
+	entries, next, err := scanPage(stub, prefix, start, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	surveyNos := make([]int64, len(entries))
+	for i, entry := range entries {
+		surveyNos[i] = surveyNoOfKey(entry.key, prefix)
+	}
+	surveys, err := getSurveys(stub, surveyNos)
+	if err != nil {
+		return nil, err
+	}
+
+	page := SurveyPage{Surveys: append([]Survey{}, surveys...)}
+	if next != nil {
+		page.NextStart = strconv.FormatInt(surveyNoOfKey(next.key, prefix), 10)
+		page.HasMore = true
+	}
+
+	return &page, nil
+}
+
+// readOwnerByAadhar : fetches the owner holding an Aadhar number
+func (t *SimpleChaincode) readOwnerByAadhar(stub shim.ChaincodeStubInterface, args aadharArgs) (*Owner, error) {
+	aadhar, err := parseAadhar(args.Aadhar)
+	if err != nil {
+		return nil, err
+	}
+
+	nameAsBytes, err := stub.GetState(aadharKey(aadhar))
+	if err != nil {
+		return nil, errInternal("Failed to get Aadhar index: %s", err)
+	}
+	if nameAsBytes == nil {
+		return nil, errNotFound("No owner holds Aadhar number %d", aadhar)
+	}
+	owner, err := getOwner(stub, string(nameAsBytes))
+	if err != nil {
+		return nil, err
 	}
 
-	// Marshalling and appending ''
-	bytes, _ := json.Marshal(surveys)
-	return []byte(bytes), nil // returns JSON of entire survey numbers on network
+	return &owner, nil
 }
 
 func main() {
@@ -0,0 +1,1138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Callers used across the tests
+var (
+	registrar = map[string]string{"role": "registrar"}
+	notary    = map[string]string{"role": "notary"}
+	auditor   = map[string]string{"role": "auditor"}
+)
+
+func newRegistryStub(t *testing.T) *shim.MockStub {
+	stub := shim.NewMockStub("registry", new(SimpleChaincode))
+	if _, err := stub.MockInit("1", "init", []string{"99"}); err != nil {
+		fmt.Println("Init failed", err)
+		t.FailNow()
+	}
+	return stub
+}
+
+// invokeAs : runs an invoke transaction on behalf of a caller. As on a
+// peer, the writes of a failed transaction are discarded.
+func invokeAs(stub *shim.MockStub, caller map[string]string, txID string, function string, args []string) ([]byte, error) {
+	if err := stub.MockCaller(caller); err != nil {
+		return nil, err
+	}
+	stub.MockTransactionStart(txID)
+	result, err := new(SimpleChaincode).Invoke(stub, function, args)
+	if err != nil {
+		stub.MockTransactionRollback(txID)
+	} else {
+		stub.MockTransactionEnd(txID)
+	}
+	return result, err
+}
+
+// queryAs : runs a query on behalf of a caller
+func queryAs(stub *shim.MockStub, caller map[string]string, function string, args []string) ([]byte, error) {
+	if err := stub.MockCaller(caller); err != nil {
+		return nil, err
+	}
+	return new(SimpleChaincode).Query(stub, function, args)
+}
+
+// checkInvoke : runs an invoke as the role in charge of the function
+func checkInvoke(t *testing.T, stub *shim.MockStub, function string, args []string) {
+	caller := notary
+	if function == "initProperty" {
+		caller = registrar
+	}
+	if _, err := invokeAs(stub, caller, "1", function, args); err != nil {
+		fmt.Println(function, args, "failed", err)
+		t.FailNow()
+	}
+}
+
+func checkInvokeFails(t *testing.T, stub *shim.MockStub, function string, args []string) {
+	if _, err := invokeAs(stub, notary, "1", function, args); err == nil {
+		fmt.Println(function, args, "should have failed")
+		t.FailNow()
+	}
+}
+
+func loadOwner(t *testing.T, stub *shim.MockStub, name string) Owner {
+	var owner Owner
+	if err := json.Unmarshal(stub.State[ownerKey(name)], &owner); err != nil {
+		fmt.Println("Owner", name, "not stored", err)
+		t.FailNow()
+	}
+	return owner
+}
+
+func loadSurvey(t *testing.T, stub *shim.MockStub, surveyNo int64) Survey {
+	var survey Survey
+	if err := json.Unmarshal(stub.State[surveyKey(surveyNo)], &survey); err != nil {
+		fmt.Println("Survey", surveyNo, "not stored", err)
+		t.FailNow()
+	}
+	return survey
+}
+
+func TestTransferWholeProperty(t *testing.T) {
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "1200"})
+	checkInvoke(t, stub, "initProperty", []string{"bob", "444455556666", "43", "Pune", "800"})
+
+	checkInvoke(t, stub, "transfer", []string{"alice", "42", "bob"})
+
+	survey := loadSurvey(t, stub, 42)
+	if !reflect.DeepEqual(survey.Owners, []string{"bob"}) || !reflect.DeepEqual(survey.Shares, map[string]int64{"bob": 100}) {
+		t.Fatalf("Unexpected survey after transfer: %+v", survey)
+	}
+	if alice := loadOwner(t, stub, "alice"); len(alice.SurveyNos) != 0 {
+		t.Fatalf("Seller still holds %v", alice.SurveyNos)
+	}
+	if bob := loadOwner(t, stub, "bob"); !reflect.DeepEqual(bob.SurveyNos, []int64{43, 42}) {
+		t.Fatalf("Buyer holds %v", bob.SurveyNos)
+	}
+}
+
+func TestTransferPartialShare(t *testing.T) {
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "1200"})
+	checkInvoke(t, stub, "initProperty", []string{"bob", "444455556666", "43", "Pune", "800"})
+
+	checkInvoke(t, stub, "transfer", []string{"alice", "42", "bob", "30"})
+	checkInvoke(t, stub, "transfer", []string{"alice", "42", "bob", "20"})
+
+	survey := loadSurvey(t, stub, 42)
+	if !reflect.DeepEqual(survey.Owners, []string{"alice", "bob"}) || !reflect.DeepEqual(survey.Shares, map[string]int64{"alice": 50, "bob": 50}) {
+		t.Fatalf("Unexpected survey after partial transfers: %+v", survey)
+	}
+	if alice := loadOwner(t, stub, "alice"); !reflect.DeepEqual(alice.SurveyNos, []int64{42}) {
+		t.Fatalf("Seller holds %v", alice.SurveyNos)
+	}
+	if bob := loadOwner(t, stub, "bob"); !reflect.DeepEqual(bob.SurveyNos, []int64{43, 42}) {
+		t.Fatalf("Buyer holds %v", bob.SurveyNos)
+	}
+
+	// A co-owner can only move what it holds
+	checkInvokeFails(t, stub, "transfer", []string{"bob", "42", "alice", "51"})
+}
+
+func TestTransferRejectedLeavesStateUntouched(t *testing.T) {
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "1200"})
+	checkInvoke(t, stub, "initProperty", []string{"bob", "444455556666", "43", "Pune", "800"})
+
+	before := make(map[string][]byte)
+	for k, v := range stub.State {
+		before[k] = v
+	}
+
+	checkInvokeFails(t, stub, "transfer", []string{"alice", "42", "carol"})    // unknown buyer
+	checkInvokeFails(t, stub, "transfer", []string{"bob", "42", "alice"})      // seller does not own it
+	checkInvokeFails(t, stub, "transfer", []string{"alice", "44", "bob"})      // unknown survey
+	checkInvokeFails(t, stub, "transfer", []string{"alice", "42", "alice"})    // self transfer
+	checkInvokeFails(t, stub, "transfer", []string{"alice", "42", "bob", "0"}) // empty share
+	checkInvokeFails(t, stub, "transfer", []string{"alice", "x", "bob"})       // bad survey number
+
+	if !reflect.DeepEqual(before, stub.State) {
+		t.Fatalf("Rejected transfers modified the state")
+	}
+}
+
+func TestMigrateLegacyKeys(t *testing.T) {
+	stub := newRegistryStub(t)
+
+	// Records of a deployment that kept them under bare keys listed in index
+	// arrays. Its transfer kept the seller as an owner and recorded no shares.
+	stub.MockTransactionStart("legacy")
+	alice, _ := json.Marshal(Owner{Name: "alice", Aadhar: 211122223333, SurveyNos: []int64{42}})
+	bob, _ := json.Marshal(Owner{Name: "bob", Aadhar: 444455556666, SurveyNos: []int64{42}})
+	survey, _ := json.Marshal(Survey{SurveyNo: 42, Area: 1200, Location: "Pune", Owners: []string{"alice", "bob", "alice"}})
+	stub.PutState("alice", alice)
+	stub.PutState("bob", bob)
+	stub.PutState("42", survey)
+	stub.PutState(legacyOwnerIndex, []byte(`["alice","bob"]`))
+	stub.PutState(legacySurveyIndex, []byte(`[42]`))
+	stub.MockTransactionEnd("legacy")
+
+	if _, err := invokeAs(stub, registrar, "2", "migrateLegacyKeys", nil); err == nil {
+		t.Fatalf("migrateLegacyKeys should be reserved to admins")
+	}
+	admin := map[string]string{"role": "admin"}
+	bytes, err := invokeAs(stub, admin, "3", "migrateLegacyKeys", nil)
+	if err != nil {
+		t.Fatalf("migrateLegacyKeys failed: %s", err)
+	}
+	var result MigrationResult
+	if err = json.Unmarshal(bytes, &result); err != nil || result != (MigrationResult{Owners: 2, Surveys: 1}) {
+		t.Fatalf("Unexpected migration result %s", bytes)
+	}
+	for _, key := range []string{"alice", "bob", "42", legacyOwnerIndex, legacySurveyIndex} {
+		if _, ok := stub.State[key]; ok {
+			t.Fatalf("Legacy key %s was not deleted", key)
+		}
+	}
+	if string(stub.State[aadharKey(444455556666)]) != "bob" || string(stub.State[locationKey("Pune", 42)]) != "42" {
+		t.Fatalf("Index entries of the migrated records are missing")
+	}
+	if migrated := loadSurvey(t, stub, 42); migrated.Shares["alice"] != 50 || migrated.Shares["bob"] != 50 {
+		t.Fatalf("Unexpected shares after migration: %+v", migrated)
+	}
+
+	// Nothing is left to move once done
+	bytes, err = invokeAs(stub, admin, "4", "migrateLegacyKeys", nil)
+	if err != nil || json.Unmarshal(bytes, &result) != nil || result != (MigrationResult{}) {
+		t.Fatalf("Unexpected second migration %s: %v", bytes, err)
+	}
+
+	checkInvoke(t, stub, "transfer", []string{"alice", "42", "bob"})
+	migrated := loadSurvey(t, stub, 42)
+	if !reflect.DeepEqual(migrated.Owners, []string{"bob"}) || migrated.Shares["bob"] != 100 {
+		t.Fatalf("Unexpected survey after transfer of a migrated survey: %+v", migrated)
+	}
+}
+
+func TestReadSurveyHistory(t *testing.T) {
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "1200"})
+	checkInvoke(t, stub, "initProperty", []string{"bob", "444455556666", "43", "Pune", "800"})
+	if _, err := invokeAs(stub, notary, "tx-sale-1", "transfer", []string{"alice", "42", "bob", "40"}); err != nil {
+		t.Fatalf("transfer failed: %s", err)
+	}
+	if _, err := invokeAs(stub, notary, "tx-sale-2", "transfer", []string{"alice", "42", "bob"}); err != nil {
+		t.Fatalf("transfer failed: %s", err)
+	}
+
+	bytes, err := queryAs(stub, auditor, "readSurveyHistory", []string{"42", "0", "2"})
+	if err != nil {
+		t.Fatalf("readSurveyHistory failed: %s", err)
+	}
+	var page HistoryPage
+	if err = json.Unmarshal(bytes, &page); err != nil {
+		t.Fatalf("readSurveyHistory returned %s: %s", bytes, err)
+	}
+	if len(page.Records) != 2 || !page.HasMore || page.NextStart != 2 {
+		t.Fatalf("Unexpected first page %s", bytes)
+	}
+	if r := page.Records[0]; r.Seller != "" || r.Buyer != "alice" || r.Share != 100 {
+		t.Fatalf("Unexpected registration record %+v", r)
+	}
+	if r := page.Records[1]; r.Seller != "alice" || r.Buyer != "bob" || r.Share != 40 || r.TxID != "tx-sale-1" {
+		t.Fatalf("Unexpected transfer record %+v", r)
+	}
+
+	bytes, err = queryAs(stub, auditor, "readSurveyHistory", []string{"42", "2"})
+	if err != nil {
+		t.Fatalf("readSurveyHistory failed: %s", err)
+	}
+	page = HistoryPage{}
+	if err = json.Unmarshal(bytes, &page); err != nil {
+		t.Fatalf("readSurveyHistory returned %s: %s", bytes, err)
+	}
+	if len(page.Records) != 1 || page.HasMore || page.Records[0].Share != 60 || page.Records[0].TxID != "tx-sale-2" {
+		t.Fatalf("Unexpected last page %s", bytes)
+	}
+
+	if _, err = queryAs(stub, auditor, "readSurveyHistory", []string{"44"}); err == nil {
+		t.Fatalf("readSurveyHistory should fail for an unknown survey")
+	}
+
+	// A record missing from the counted history is reported, not decoded
+	delete(stub.State, historyRecordKey(42, 1))
+	_, err = queryAs(stub, auditor, "readSurveyHistory", []string{"42"})
+	if registryErr, ok := err.(*RegistryError); !ok || registryErr.Code != codeInternal {
+		t.Fatalf("Expected %s for a missing history record, got %v", codeInternal, err)
+	}
+}
+
+func TestReadSurveyAsOfAndVersions(t *testing.T) {
+	// Each transaction commits a block, starting with block 0 for init
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "1200"}) // block 1
+	checkInvoke(t, stub, "initProperty", []string{"bob", "444455556666", "43", "Pune", "800"})    // block 2
+	if _, err := invokeAs(stub, notary, "tx-sale-1", "transfer", []string{"alice", "42", "bob", "40"}); err != nil {
+		t.Fatalf("transfer failed: %s", err)
+	}
+
+	readAsOf := func(block string) (Survey, error) {
+		var survey Survey
+		bytes, err := queryAs(stub, auditor, "readSurveyAsOf", []string{"42", block})
+		if err == nil {
+			err = json.Unmarshal(bytes, &survey)
+		}
+		return survey, err
+	}
+	if survey, err := readAsOf("2"); err != nil || !reflect.DeepEqual(survey.Owners, []string{"alice"}) {
+		t.Fatalf("Survey as of block 2 is %+v: %v", survey, err)
+	}
+	if survey, err := readAsOf("3"); err != nil || survey.Shares["bob"] != 40 {
+		t.Fatalf("Survey as of block 3 is %+v: %v", survey, err)
+	}
+	if _, err := readAsOf("0"); err == nil || err.(*RegistryError).Code != codeNotFound {
+		t.Fatalf("Survey as of block 0 should not be found: %v", err)
+	}
+	if _, err := readAsOf("4"); err == nil || err.(*RegistryError).Code != codeFailedPrecondition {
+		t.Fatalf("Survey as of an uncommitted block should fail: %v", err)
+	}
+
+	bytes, err := queryAs(stub, auditor, "readSurveyVersions", []string{"42"})
+	if err != nil {
+		t.Fatalf("readSurveyVersions failed: %s", err)
+	}
+	var versions []SurveyVersion
+	if err = json.Unmarshal(bytes, &versions); err != nil {
+		t.Fatalf("readSurveyVersions returned %s: %s", bytes, err)
+	}
+	if len(versions) != 2 || versions[0].BlockNumber != 1 || versions[1].BlockNumber != 3 {
+		t.Fatalf("Unexpected versions %s", bytes)
+	}
+	if v := versions[1]; !reflect.DeepEqual(v.TxIDs, []string{"tx-sale-1"}) || v.Deleted || v.Survey.Shares["alice"] != 60 {
+		t.Fatalf("Unexpected version %s", bytes)
+	}
+}
+
+// registryState : the owners and surveys stored in a stub, by key
+func registryState(stub *shim.MockStub) (map[string]Owner, map[int64]Survey, error) {
+	owners := make(map[string]Owner)
+	surveys := make(map[int64]Survey)
+	for key, value := range stub.State {
+		switch {
+		case strings.HasPrefix(key, ownerPrefix):
+			var owner Owner
+			if err := json.Unmarshal(value, &owner); err != nil {
+				return nil, nil, err
+			}
+			owners[owner.Name] = owner
+		case strings.HasPrefix(key, surveyPrefix):
+			surveyNo := surveyNoOfKey(key, surveyPrefix)
+			survey, err := decodeSurvey(surveyNo, value)
+			if err != nil {
+				return nil, nil, err
+			}
+			surveys[surveyNo] = *survey
+		}
+	}
+	return owners, surveys, nil
+}
+
+// ownersHoldTheirSurveys : every survey in force is held by each of its
+// owners, and owners hold no other survey
+func ownersHoldTheirSurveys(stub *shim.MockStub) error {
+	owners, surveys, err := registryState(stub)
+	if err != nil {
+		return err
+	}
+	for surveyNo, survey := range surveys {
+		if survey.Retired {
+			continue
+		}
+		for _, name := range survey.Owners {
+			if SliceIndex(len(owners[name].SurveyNos), func(i int) bool { return owners[name].SurveyNos[i] == surveyNo }) == -1 {
+				return fmt.Errorf("owner %s of survey %d holds %v", name, surveyNo, owners[name].SurveyNos)
+			}
+		}
+	}
+	for name, owner := range owners {
+		for _, surveyNo := range owner.SurveyNos {
+			survey, ok := surveys[surveyNo]
+			if !ok || survey.Retired || SliceIndex(len(survey.Owners), func(i int) bool { return survey.Owners[i] == name }) == -1 {
+				return fmt.Errorf("%s holds survey %d owned by %v", name, surveyNo, survey.Owners)
+			}
+		}
+	}
+	return nil
+}
+
+// sharesAreWhole : the shares of every survey add up to a full share
+func sharesAreWhole(stub *shim.MockStub) error {
+	_, surveys, err := registryState(stub)
+	if err != nil {
+		return err
+	}
+	for surveyNo, survey := range surveys {
+		var total int64
+		for _, share := range survey.Shares {
+			total += share
+		}
+		if total != fullShare || len(survey.Shares) != len(survey.Owners) {
+			return fmt.Errorf("survey %d owned by %v in shares %v", surveyNo, survey.Owners, survey.Shares)
+		}
+	}
+	return nil
+}
+
+// adjacencyIsMutual : surveys in force adjoin only surveys in force that
+// adjoin them back
+func adjacencyIsMutual(stub *shim.MockStub) error {
+	_, surveys, err := registryState(stub)
+	if err != nil {
+		return err
+	}
+	for surveyNo, survey := range surveys {
+		if survey.Retired {
+			continue
+		}
+		for _, adjacentNo := range survey.Adjacent {
+			adjacent, ok := surveys[adjacentNo]
+			if !ok || adjacent.Retired || indexOfSurveyNo(adjacent.Adjacent, surveyNo) == -1 {
+				return fmt.Errorf("survey %d adjoins %d, which adjoins %v", surveyNo, adjacentNo, adjacent.Adjacent)
+			}
+		}
+	}
+	return nil
+}
+
+func TestRegistryInvariants(t *testing.T) {
+	names := shim.GenOneOf("alice", "bob", "carol")
+	aadhars := map[string]string{"alice": "211122223333", "bob": "444455556666", "carol": "777788889999"}
+	surveyNos := shim.GenOneOf("1", "2", "3", "4")
+	// transfers mostly move surveys in force from one of their owners
+	heldSurveys := shim.GenFunc(func(r *rand.Rand, stub *shim.MockStub) string {
+		_, surveys, _ := registryState(stub)
+		var held []string
+		for surveyNo, survey := range surveys {
+			if !survey.Retired {
+				held = append(held, strconv.FormatInt(surveyNo, 10))
+			}
+		}
+		if len(held) == 0 {
+			return surveyNos.Generate(r, stub)
+		}
+		sort.Strings(held)
+		return held[r.Intn(len(held))]
+	})
+	// owners picks a registered owner, holding a survey in force if held
+	owners := func(held bool) shim.Gen {
+		return shim.GenFunc(func(r *rand.Rand, stub *shim.MockStub) string {
+			owners, _, _ := registryState(stub)
+			var picked []string
+			for name, owner := range owners {
+				if !held || len(owner.SurveyNos) > 0 {
+					picked = append(picked, name)
+				}
+			}
+			if len(picked) == 0 {
+				return names.Generate(r, stub)
+			}
+			sort.Strings(picked)
+			return picked[r.Intn(len(picked))]
+		})
+	}
+
+	p := &shim.Property{
+		Setup: func() (*shim.MockStub, error) {
+			stub := shim.NewMockStub("registry", new(SimpleChaincode))
+			_, err := stub.MockInit("init", "init", []string{"99"})
+			return stub, err
+		},
+		Calls: []shim.Call{
+			{Function: "initProperty", Args: []shim.Gen{names, surveyNos, shim.GenOneOf("Pune", "Nashik"), shim.GenInt(100, 1000)}, Weight: 2},
+			{Function: "transfer", Args: []shim.Gen{owners(true), heldSurveys, owners(false), shim.GenInt(1, 60)}, Weight: 3},
+			{Function: "transfer", Args: []shim.Gen{owners(true), heldSurveys, owners(false)}, Weight: 2},
+			{Function: "transfer", Args: []shim.Gen{names, surveyNos, names, shim.GenInt(1, 100)}},
+			{Function: "recordAdjacency", Args: []shim.Gen{surveyNos, surveyNos}},
+			{Function: "mergeSurveys", Args: []shim.Gen{shim.GenOneOf("5", "6"), surveyNos, surveyNos}},
+		},
+		Invariants: []shim.Invariant{
+			{Name: "owners hold their surveys", Check: ownersHoldTheirSurveys},
+			{Name: "shares are whole", Check: sharesAreWhole},
+			{Name: "adjacency is mutual", Check: adjacencyIsMutual},
+		},
+		// Each owner registers under their own Aadhar number, and each
+		// function is called by the role in charge of it
+		Invoke: func(stub *shim.MockStub, txid string, step shim.Step) error {
+			args, caller := step.Args, notary
+			if step.Function == "initProperty" {
+				args = append([]string{args[0], aadhars[args[0]]}, args[1:]...)
+				caller = registrar
+			} else if step.Function == "mergeSurveys" || step.Function == "recordAdjacency" {
+				caller = registrar
+			}
+			_, err := invokeAs(stub, caller, txid, step.Function, args)
+			return err
+		},
+		Runs:  50,
+		Steps: 25,
+		Seed:  20160901,
+	}
+	if err := p.Check(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAccessPolicy(t *testing.T) {
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "1200"})
+	checkInvoke(t, stub, "initProperty", []string{"bob", "444455556666", "43", "Pune", "800"})
+
+	alice := map[string]string{"aadhar": "211122223333"}
+	bob := map[string]string{"aadhar": "444455556666"}
+
+	checkDenied := func(err error, code string) {
+		registryErr, ok := err.(*RegistryError)
+		if !ok || registryErr.Code != code {
+			t.Fatalf("Expected %s, got %v", code, err)
+		}
+	}
+
+	// Only registrars register property
+	_, err := invokeAs(stub, notary, "2", "initProperty", []string{"carol", "777788889999", "44", "Pune", "500"})
+	checkDenied(err, codeAccessDenied)
+	_, err = invokeAs(stub, nil, "2", "initProperty", []string{"carol", "777788889999", "44", "Pune", "500"})
+	checkDenied(err, codeUnauthenticated)
+
+	// Only the seller or a notary transfers
+	_, err = invokeAs(stub, bob, "3", "transfer", []string{"alice", "42", "bob"})
+	checkDenied(err, codeAccessDenied)
+	_, err = invokeAs(stub, registrar, "3", "transfer", []string{"alice", "42", "bob"})
+	checkDenied(err, codeAccessDenied)
+	if _, err = invokeAs(stub, alice, "3", "transfer", []string{"alice", "42", "bob", "50"}); err != nil {
+		t.Fatalf("Owner could not transfer: %s", err)
+	}
+
+	// simulateTransfer is reserved to admins, and debug is gone
+	_, err = queryAs(stub, notary, "simulateTransfer", []string{"alice", "42", "bob"})
+	checkDenied(err, codeAccessDenied)
+	_, err = invokeAs(stub, map[string]string{"role": "admin"}, "4", "debug", []string{"alice", "42", "bob"})
+	checkDenied(err, codeUnknownFunction)
+
+	// Auditors read but do not write
+	if _, err = queryAs(stub, auditor, "readSurvey", []string{"42"}); err != nil {
+		t.Fatalf("Auditor could not read: %s", err)
+	}
+	_, err = invokeAs(stub, auditor, "5", "transfer", []string{"bob", "42", "alice"})
+	checkDenied(err, codeAccessDenied)
+	_, err = queryAs(stub, alice, "readSurvey", []string{"42"})
+	checkDenied(err, codeUnauthenticated)
+
+	if _, err = queryAs(stub, auditor, "noSuchQuery", nil); err == nil {
+		t.Fatalf("Unknown query should fail")
+	}
+}
+
+func TestListingQueries(t *testing.T) {
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"carol", "777788889999", "100", "Nashik", "500"})
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "9", "Pune", "1200"})
+	checkInvoke(t, stub, "initProperty", []string{"bob", "444455556666", "43", "Pune", "800"})
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "300"})
+
+	// A second owner cannot reuse an Aadhar number
+	checkInvokeFails(t, stub, "initProperty", []string{"dave", "211122223333", "7", "Pune", "300"})
+
+	bytes, err := queryAs(stub, auditor, "readOwnerIndex", []string{"", "2"})
+	if err != nil {
+		t.Fatalf("readOwnerIndex failed: %s", err)
+	}
+	var owners OwnerPage
+	if err = json.Unmarshal(bytes, &owners); err != nil {
+		t.Fatalf("readOwnerIndex returned %s: %s", bytes, err)
+	}
+	if len(owners.Owners) != 2 || owners.Owners[0].Name != "alice" || owners.Owners[1].Name != "bob" || !owners.HasMore || owners.NextStart != "carol" {
+		t.Fatalf("Unexpected owner page %s", bytes)
+	}
+
+	// Surveys list in numeric order
+	bytes, err = queryAs(stub, auditor, "readSurveyIndex", []string{"10"})
+	if err != nil {
+		t.Fatalf("readSurveyIndex failed: %s", err)
+	}
+	var surveys SurveyPage
+	if err = json.Unmarshal(bytes, &surveys); err != nil {
+		t.Fatalf("readSurveyIndex returned %s: %s", bytes, err)
+	}
+	if len(surveys.Surveys) != 3 || surveys.Surveys[0].SurveyNo != 42 || surveys.Surveys[2].SurveyNo != 100 || surveys.HasMore {
+		t.Fatalf("Unexpected survey page %s", bytes)
+	}
+
+	bytes, err = queryAs(stub, auditor, "readSurveysByLocation", []string{"Pune", "", "2"})
+	if err != nil {
+		t.Fatalf("readSurveysByLocation failed: %s", err)
+	}
+	surveys = SurveyPage{}
+	if err = json.Unmarshal(bytes, &surveys); err != nil {
+		t.Fatalf("readSurveysByLocation returned %s: %s", bytes, err)
+	}
+	if len(surveys.Surveys) != 2 || surveys.Surveys[0].SurveyNo != 9 || surveys.Surveys[1].SurveyNo != 42 || surveys.NextStart != "43" {
+		t.Fatalf("Unexpected location page %s", bytes)
+	}
+
+	bytes, err = queryAs(stub, auditor, "readOwnerByAadhar", []string{"444455556666"})
+	if err != nil {
+		t.Fatalf("readOwnerByAadhar failed: %s", err)
+	}
+	var owner Owner
+	if err = json.Unmarshal(bytes, &owner); err != nil || owner.Name != "bob" {
+		t.Fatalf("Unexpected owner %s", bytes)
+	}
+}
+
+// unpagedStub answers range queries like a peer without paging: it ignores
+// the page size and returns the whole range, here in reverse order
+type unpagedStub struct {
+	*shim.MockStub
+}
+
+func (stub unpagedStub) RangeQueryStatePage(startKey, endKey string, pageSize int, bookmark string) (shim.StateRangeQueryIteratorInterface, string, error) {
+	return stub.ReverseRangeQueryStatePage(startKey, endKey, 0, "")
+}
+
+func TestScanPageWithoutPeerPaging(t *testing.T) {
+	stub := newRegistryStub(t)
+	for i, surveyNo := range []string{"9", "43", "42", "100"} {
+		checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", surveyNo, "Pune", strconv.Itoa(100 * (i + 1))})
+	}
+
+	page, next, err := scanPage(unpagedStub{stub}, surveyPrefix, padSurveyNo(10), 2)
+	if err != nil {
+		t.Fatalf("scanPage failed: %s", err)
+	}
+	if len(page) != 2 || page[0].key != surveyKey(42) || page[1].key != surveyKey(43) || next == nil || next.key != surveyKey(100) {
+		t.Fatalf("Unexpected page %v, next %v", page, next)
+	}
+	page, next, err = scanPage(unpagedStub{stub}, surveyPrefix, padSurveyNo(43), 2)
+	if err != nil || len(page) != 2 || page[0].key != surveyKey(43) || page[1].key != surveyKey(100) || next != nil {
+		t.Fatalf("Unexpected last page %v, next %v: %v", page, next, err)
+	}
+}
+
+func TestEncumberedTransferNeedsConsent(t *testing.T) {
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "1200"})
+	checkInvoke(t, stub, "initProperty", []string{"bob", "444455556666", "43", "Pune", "800"})
+
+	bank := map[string]string{"holder": "SBI"}
+	otherBank := map[string]string{"holder": "HDFC"}
+
+	// A lienholder only registers encumbrances in its own name
+	if _, err := invokeAs(stub, otherBank, "2", "registerEncumbrance", []string{"42", "mortgage", "SBI", "500000", "LN-1"}); err == nil {
+		t.Fatalf("HDFC registered a mortgage for SBI")
+	}
+	if _, err := invokeAs(stub, bank, "2", "registerEncumbrance", []string{"42", "mortgage", "SBI", "500000", "LN-1"}); err != nil {
+		t.Fatalf("registerEncumbrance failed: %s", err)
+	}
+	if survey := loadSurvey(t, stub, 42); survey.Encumbrances != 1 {
+		t.Fatalf("Survey not marked encumbered: %+v", survey)
+	}
+
+	checkInvokeFails(t, stub, "transfer", []string{"alice", "42", "bob"})
+
+	// Only the holder consents, and only for the named buyer
+	if _, err := invokeAs(stub, otherBank, "3", "consentTransfer", []string{"42", "0", "bob"}); err == nil {
+		t.Fatalf("HDFC consented to SBI's mortgage")
+	}
+	if _, err := invokeAs(stub, bank, "3", "consentTransfer", []string{"42", "0", "bob"}); err != nil {
+		t.Fatalf("consentTransfer failed: %s", err)
+	}
+	checkInvoke(t, stub, "transfer", []string{"alice", "42", "bob", "50"})
+
+	// The consent is spent by the transfer
+	checkInvokeFails(t, stub, "transfer", []string{"alice", "42", "bob", "50"})
+
+	if _, err := invokeAs(stub, bank, "4", "releaseEncumbrance", []string{"42", "0"}); err != nil {
+		t.Fatalf("releaseEncumbrance failed: %s", err)
+	}
+	checkInvoke(t, stub, "transfer", []string{"alice", "42", "bob", "50"})
+
+	bytes, err := queryAs(stub, auditor, "readEncumbrances", []string{"42"})
+	if err != nil {
+		t.Fatalf("readEncumbrances failed: %s", err)
+	}
+	var encumbrances []Encumbrance
+	if err = json.Unmarshal(bytes, &encumbrances); err != nil {
+		t.Fatalf("readEncumbrances returned %s: %s", bytes, err)
+	}
+	if len(encumbrances) != 1 || encumbrances[0].Active || encumbrances[0].Holder != "SBI" || encumbrances[0].ReleasedTx != "4" {
+		t.Fatalf("Unexpected encumbrances %s", bytes)
+	}
+	if survey := loadSurvey(t, stub, 42); survey.Encumbrances != 0 {
+		t.Fatalf("Survey still marked encumbered: %+v", survey)
+	}
+
+	// Encumbrances list by sequence number, not by key
+	for i := 1; i <= 10; i++ {
+		if _, err = invokeAs(stub, registrar, "e"+strconv.Itoa(i), "registerEncumbrance", []string{"42", "lien", "SBI", "1000", "LN-" + strconv.Itoa(i)}); err != nil {
+			t.Fatalf("registerEncumbrance failed: %s", err)
+		}
+	}
+	bytes, err = queryAs(stub, auditor, "readEncumbrances", []string{"42"})
+	encumbrances = nil
+	if err != nil || json.Unmarshal(bytes, &encumbrances) != nil || len(encumbrances) != 11 {
+		t.Fatalf("Unexpected encumbrances %s: %v", bytes, err)
+	}
+	for i, encumbrance := range encumbrances {
+		if encumbrance.Seq != int64(i) {
+			t.Fatalf("Encumbrance %d listed at %d", encumbrance.Seq, i)
+		}
+	}
+}
+
+func TestSubdivideAndMergeSurveys(t *testing.T) {
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "1200"})
+	checkInvoke(t, stub, "initProperty", []string{"bob", "444455556666", "43", "Pune", "800"})
+	checkInvoke(t, stub, "transfer", []string{"alice", "42", "bob", "25"})
+
+	// Child areas must add up to the parent's
+	checkInvokeFails(t, stub, "subdivideSurvey", []string{"42", "421", "500", "422", "600"})
+	// Children must be new surveys
+	checkInvokeFails(t, stub, "subdivideSurvey", []string{"42", "43", "600", "422", "600"})
+
+	if _, err := invokeAs(stub, registrar, "2", "recordAdjacency", []string{"42", "43"}); err != nil {
+		t.Fatalf("recordAdjacency failed: %s", err)
+	}
+	if _, err := invokeAs(stub, registrar, "2", "subdivideSurvey", []string{"42", "421", "500", "422", "700"}); err != nil {
+		t.Fatalf("subdivideSurvey failed: %s", err)
+	}
+	// The children start with no adjacency, and the neighbour loses the parent
+	if neighbour := loadSurvey(t, stub, 43); len(neighbour.Adjacent) != 0 {
+		t.Fatalf("Neighbour still adjoins the parent: %+v", neighbour)
+	}
+	parent := loadSurvey(t, stub, 42)
+	if !parent.Retired || !reflect.DeepEqual(parent.Children, []int64{421, 422}) {
+		t.Fatalf("Parent not retired: %+v", parent)
+	}
+	child := loadSurvey(t, stub, 422)
+	if child.Area != 700 || child.Location != "Pune" || !reflect.DeepEqual(child.Parents, []int64{42}) ||
+		!reflect.DeepEqual(child.Shares, map[string]int64{"alice": 75, "bob": 25}) {
+		t.Fatalf("Unexpected child: %+v", child)
+	}
+	if alice := loadOwner(t, stub, "alice"); !reflect.DeepEqual(alice.SurveyNos, []int64{421, 422}) {
+		t.Fatalf("alice holds %v", alice.SurveyNos)
+	}
+	if bob := loadOwner(t, stub, "bob"); !reflect.DeepEqual(bob.SurveyNos, []int64{43, 421, 422}) {
+		t.Fatalf("bob holds %v", bob.SurveyNos)
+	}
+
+	// A retired survey no longer changes hands
+	checkInvokeFails(t, stub, "transfer", []string{"alice", "42", "bob"})
+
+	// Only surveys recorded as adjacent merge
+	_, err := invokeAs(stub, registrar, "3", "mergeSurveys", []string{"500", "421", "422"})
+	if registryErr, ok := err.(*RegistryError); !ok || registryErr.Code != codeFailedPrecondition {
+		t.Fatalf("Expected %s merging surveys not recorded as adjacent, got %v", codeFailedPrecondition, err)
+	}
+	for i, args := range [][]string{{"421", "422"}, {"421", "43"}} {
+		if _, err = invokeAs(stub, registrar, "a"+strconv.Itoa(i), "recordAdjacency", args); err != nil {
+			t.Fatalf("recordAdjacency failed: %s", err)
+		}
+	}
+	if _, err = invokeAs(stub, registrar, "a2", "recordAdjacency", []string{"422", "421"}); err == nil {
+		t.Fatalf("Recorded the same adjacency twice")
+	}
+	if _, err = invokeAs(stub, registrar, "a3", "recordAdjacency", []string{"42", "43"}); err == nil {
+		t.Fatalf("Recorded the adjacency of a retired survey")
+	}
+
+	// Only surveys with identical ownership merge
+	if _, err = invokeAs(stub, registrar, "3", "mergeSurveys", []string{"500", "421", "43"}); err == nil {
+		t.Fatalf("Merged surveys with different owners")
+	}
+	if _, err = invokeAs(stub, registrar, "3", "mergeSurveys", []string{"500", "421", "422"}); err != nil {
+		t.Fatalf("mergeSurveys failed: %s", err)
+	}
+	merged := loadSurvey(t, stub, 500)
+	if merged.Area != 1200 || !reflect.DeepEqual(merged.Parents, []int64{421, 422}) || !reflect.DeepEqual(merged.Adjacent, []int64{43}) {
+		t.Fatalf("Unexpected merged survey: %+v", merged)
+	}
+	if child = loadSurvey(t, stub, 421); !child.Retired || !reflect.DeepEqual(child.Children, []int64{500}) {
+		t.Fatalf("Merged survey not retired: %+v", child)
+	}
+	if neighbour := loadSurvey(t, stub, 43); !reflect.DeepEqual(neighbour.Adjacent, []int64{500}) {
+		t.Fatalf("Neighbour not updated: %+v", neighbour)
+	}
+	if alice := loadOwner(t, stub, "alice"); !reflect.DeepEqual(alice.SurveyNos, []int64{500}) {
+		t.Fatalf("alice holds %v", alice.SurveyNos)
+	}
+
+	// The listings leave the retired surveys out
+	for _, query := range [][]string{{"readSurveyIndex"}, {"readSurveysByLocation", "Pune"}} {
+		bytes, err := queryAs(stub, auditor, query[0], query[1:])
+		var page SurveyPage
+		if err != nil || json.Unmarshal(bytes, &page) != nil {
+			t.Fatalf("%s failed: %s", query[0], err)
+		}
+		var surveyNos []int64
+		for _, survey := range page.Surveys {
+			surveyNos = append(surveyNos, survey.SurveyNo)
+		}
+		if !reflect.DeepEqual(surveyNos, []int64{43, 500}) {
+			t.Fatalf("%s listed surveys %v", query[0], surveyNos)
+		}
+	}
+	checkInvoke(t, stub, "transfer", []string{"alice", "500", "bob"})
+}
+
+// invokeAt : runs an invoke transaction on behalf of a caller at the given
+// unix time and returns the events it emitted
+func invokeAt(stub *shim.MockStub, caller map[string]string, txID string, now int64, function string, args []string) ([]string, error) {
+	stub.Clock = func() time.Time { return time.Unix(now, 0) }
+	emitted := len(stub.Events)
+	_, err := invokeAs(stub, caller, txID, function, args)
+	var events []string
+	for _, event := range stub.Events[emitted:] {
+		events = append(events, event.EventName)
+	}
+	return events, err
+}
+
+func TestSaleAgreement(t *testing.T) {
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "1200"})
+	checkInvoke(t, stub, "initProperty", []string{"bob", "444455556666", "43", "Pune", "800"})
+	checkInvoke(t, stub, "initProperty", []string{"carol", "777788889999", "44", "Pune", "600"})
+
+	alice := map[string]string{"aadhar": "211122223333"}
+	bob := map[string]string{"aadhar": "444455556666"}
+	start := int64(1500000000)
+
+	// Only the seller proposes, and the buyer accepts
+	if _, err := invokeAt(stub, bob, "s1", start, "proposeSale", []string{"alice", "42", "bob", "40", "2500000", "cash", "3600"}); err == nil {
+		t.Fatalf("bob proposed a sale of alice's survey")
+	}
+	events, err := invokeAt(stub, alice, "s1", start, "proposeSale", []string{"alice", "42", "bob", "40", "2500000", "cash", "3600"})
+	if err != nil || !reflect.DeepEqual(events, []string{"saleProposed"}) {
+		t.Fatalf("proposeSale failed: %s, events %v", err, events)
+	}
+	if _, err = invokeAt(stub, alice, "2", start+60, "acceptSale", []string{"s1"}); err == nil {
+		t.Fatalf("alice accepted her own sale")
+	}
+	// Steps are taken in order
+	if _, err = invokeAt(stub, registrar, "2", start+60, "approveSale", []string{"s1"}); err == nil {
+		t.Fatalf("Approved a sale that was not accepted")
+	}
+	if events, err = invokeAt(stub, bob, "2", start+60, "acceptSale", []string{"s1"}); err != nil || !reflect.DeepEqual(events, []string{"saleAccepted"}) {
+		t.Fatalf("acceptSale failed: %s, events %v", err, events)
+	}
+
+	// The survey is held in escrow for the accepted sale
+	if survey := loadSurvey(t, stub, 42); survey.Escrow != "s1" {
+		t.Fatalf("Survey not held in escrow: %+v", survey)
+	}
+	checkInvokeFails(t, stub, "transfer", []string{"alice", "42", "carol"})
+	if _, err = invokeAt(stub, alice, "3", start+60, "cancelSale", []string{"s1"}); err == nil {
+		t.Fatalf("Seller cancelled an accepted sale before its deadline")
+	}
+
+	bytes, err := queryAs(stub, auditor, "readPendingSales", []string{"bob"})
+	if err != nil {
+		t.Fatalf("readPendingSales failed: %s", err)
+	}
+	var page SalePage
+	if err = json.Unmarshal(bytes, &page); err != nil || len(page.Sales) != 1 || page.Sales[0].Status != saleAccepted {
+		t.Fatalf("Unexpected pending sales %s", bytes)
+	}
+
+	if events, err = invokeAt(stub, registrar, "3", start+120, "approveSale", []string{"s1"}); err != nil || !reflect.DeepEqual(events, []string{"saleApproved"}) {
+		t.Fatalf("approveSale failed: %s, events %v", err, events)
+	}
+	if events, err = invokeAt(stub, alice, "4", start+180, "finalizeSale", []string{"s1"}); err != nil || !reflect.DeepEqual(events, []string{"saleFinalized"}) {
+		t.Fatalf("finalizeSale failed: %s, events %v", err, events)
+	}
+	survey := loadSurvey(t, stub, 42)
+	if survey.Escrow != "" || !reflect.DeepEqual(survey.Shares, map[string]int64{"alice": 60, "bob": 40}) {
+		t.Fatalf("Unexpected survey after sale: %+v", survey)
+	}
+	if bytes, err = queryAs(stub, auditor, "readPendingSales", []string{"alice"}); err != nil || string(bytes) != `{"sales":[],"nextStart":"","hasMore":false}` {
+		t.Fatalf("Finalized sale still pending: %s %s", bytes, err)
+	}
+
+	// An expired proposal can no longer be accepted, only cancelled
+	if _, err = invokeAt(stub, alice, "s2", start, "proposeSale", []string{"alice", "42", "carol", "60", "3000000", "cash", "3600"}); err != nil {
+		t.Fatalf("proposeSale failed: %s", err)
+	}
+	stub.Clock = func() time.Time { return time.Unix(start+3601, 0) }
+	if bytes, err = queryAs(stub, auditor, "readPendingSales", []string{"carol"}); err != nil || string(bytes) != `{"sales":[],"nextStart":"","hasMore":false}` {
+		t.Fatalf("Expired sale still pending: %s %s", bytes, err)
+	}
+	carol := map[string]string{"aadhar": "777788889999"}
+	if _, err = invokeAt(stub, carol, "5", start+3601, "acceptSale", []string{"s2"}); err == nil {
+		t.Fatalf("Accepted an expired sale")
+	}
+	if events, err = invokeAt(stub, alice, "5", start+3601, "cancelSale", []string{"s2"}); err != nil || !reflect.DeepEqual(events, []string{"saleCancelled"}) {
+		t.Fatalf("cancelSale failed: %s, events %v", err, events)
+	}
+	bytes, err = queryAs(stub, auditor, "readSale", []string{"s2"})
+	var sale Sale
+	if err != nil || json.Unmarshal(bytes, &sale) != nil || sale.Status != saleCancelled || sale.CancelledTx != "5" {
+		t.Fatalf("Unexpected cancelled sale %s", bytes)
+	}
+
+	// A sale that cannot be read is not overwritten by a new proposal
+	stub.MockTransactionStart("corrupt")
+	stub.PutState(saleKey("s3"), []byte("{"))
+	stub.MockTransactionEnd("corrupt")
+	_, err = invokeAt(stub, alice, "s3", start+3601, "proposeSale", []string{"alice", "42", "carol", "60", "3000000", "cash", "3600"})
+	if registryErr, ok := err.(*RegistryError); !ok || registryErr.Code != codeInternal {
+		t.Fatalf("Expected %s, got %v", codeInternal, err)
+	}
+	if string(stub.State[saleKey("s3")]) != "{" {
+		t.Fatalf("Unreadable sale was overwritten")
+	}
+
+	// The buyer declines a proposal
+	if _, err = invokeAt(stub, alice, "s4", start+3601, "proposeSale", []string{"alice", "42", "bob", "60", "3000000", "cash", "3600"}); err != nil {
+		t.Fatalf("proposeSale failed: %s", err)
+	}
+	if events, err = invokeAt(stub, bob, "6", start+3602, "cancelSale", []string{"s4"}); err != nil || !reflect.DeepEqual(events, []string{"saleCancelled"}) {
+		t.Fatalf("Buyer could not decline: %s, events %v", err, events)
+	}
+
+	// An accepted sale past its deadline is listed as expired, and the buyer
+	// cancels it to release the escrow
+	listSales := func(function string, party string) []string {
+		bytes, err := queryAs(stub, auditor, function, []string{party})
+		var page SalePage
+		if err != nil || json.Unmarshal(bytes, &page) != nil {
+			t.Fatalf("%s failed: %s", function, err)
+		}
+		var ids []string
+		for _, sale := range page.Sales {
+			ids = append(ids, sale.ID)
+		}
+		return ids
+	}
+	if _, err = invokeAt(stub, alice, "s5", start+3700, "proposeSale", []string{"alice", "42", "carol", "60", "3000000", "cash", "3600"}); err != nil {
+		t.Fatalf("proposeSale failed: %s", err)
+	}
+	if _, err = invokeAt(stub, carol, "7", start+3800, "acceptSale", []string{"s5"}); err != nil {
+		t.Fatalf("acceptSale failed: %s", err)
+	}
+	_, err = invokeAt(stub, bob, "8", start+7301, "cancelSale", []string{"s5"})
+	if registryErr, ok := err.(*RegistryError); !ok || registryErr.Code != codeAccessDenied {
+		t.Fatalf("Expected %s for a third party cancelling, got %v", codeAccessDenied, err)
+	}
+	if _, err = invokeAt(stub, carol, "8", start+3900, "cancelSale", []string{"s5"}); err == nil {
+		t.Fatalf("Buyer cancelled an accepted sale before its deadline")
+	}
+	if pending, expiredSales := listSales("readPendingSales", "carol"), listSales("readExpiredSales", "carol"); !reflect.DeepEqual(pending, []string{"s5"}) || len(expiredSales) != 0 {
+		t.Fatalf("carol has pending sales %v and expired sales %v", pending, expiredSales)
+	}
+	stub.Clock = func() time.Time { return time.Unix(start+7301, 0) }
+	if pending, expiredSales := listSales("readPendingSales", "carol"), listSales("readExpiredSales", "carol"); len(pending) != 0 || !reflect.DeepEqual(expiredSales, []string{"s5"}) {
+		t.Fatalf("carol has pending sales %v and expired sales %v", pending, expiredSales)
+	}
+	if events, err = invokeAt(stub, carol, "8", start+7301, "cancelSale", []string{"s5"}); err != nil || !reflect.DeepEqual(events, []string{"saleCancelled"}) {
+		t.Fatalf("Buyer could not cancel an expired sale: %s, events %v", err, events)
+	}
+	if survey = loadSurvey(t, stub, 42); survey.Escrow != "" {
+		t.Fatalf("Escrow not released: %+v", survey)
+	}
+	if expiredSales := listSales("readExpiredSales", "carol"); len(expiredSales) != 0 {
+		t.Fatalf("Cancelled sale still listed as expired: %v", expiredSales)
+	}
+}
+
+func TestEveryFunctionHasPolicy(t *testing.T) {
+	cc := new(SimpleChaincode)
+	for _, check := range []struct {
+		router   *shim.Router
+		policies map[string]policy
+	}{
+		{cc.invokeRouter(), invokePolicies},
+		{cc.queryRouter(), queryPolicies},
+	} {
+		var withPolicy []string
+		for function := range check.policies {
+			withPolicy = append(withPolicy, function)
+		}
+		sort.Strings(withPolicy)
+		if routed := check.router.Functions(); !reflect.DeepEqual(routed, withPolicy) {
+			t.Fatalf("Routed functions %v, functions with a policy %v", routed, withPolicy)
+		}
+	}
+}
+
+func TestInputValidation(t *testing.T) {
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "1200"})
+
+	checkCode := func(err error, code string) {
+		registryErr, ok := err.(*RegistryError)
+		if !ok || registryErr.Code != code || registryErr.Function == "" {
+			t.Fatalf("Expected %s, got %v", code, err)
+		}
+	}
+
+	invalid := [][]string{
+		{"bob", "4444", "43", "Pune", "800"},           // short Aadhar number
+		{"bob", "144455556666", "43", "Pune", "800"},   // Aadhar numbers do not start with 1
+		{"bob", "444455556666", "x43", "Pune", "800"},  // survey number not numeric
+		{"bob", "444455556666", "-43", "Pune", "800"},  // survey number not positive
+		{"bob", "444455556666", "43", " ", "800"},      // blank location
+		{"bob", "444455556666", "43", "Pune", "0"},     // area not positive
+		{"", "444455556666", "43", "Pune", "800"},      // blank name
+		{"alice", "444455556666", "43", "Pune", "800"}, // alice holds another Aadhar number
+	}
+	for _, args := range invalid {
+		_, err := invokeAs(stub, registrar, "2", "initProperty", args)
+		checkCode(err, codeInvalidArgument)
+	}
+	if _, ok := stub.State[surveyKey(43)]; ok {
+		t.Fatalf("Invalid registration was stored")
+	}
+
+	_, err := invokeAs(stub, registrar, "2", "initProperty", []string{"bob", "444455556666", "42", "Pune", "800"})
+	checkCode(err, codeAlreadyExists)
+	_, err = invokeAs(stub, notary, "2", "transfer", []string{"alice", "42", "nobody"})
+	checkCode(err, codeNotFound)
+	_, err = invokeAs(stub, notary, "2", "noSuchFunction", nil)
+	checkCode(err, codeUnknownFunction)
+
+	// The router rejects malformed calls before the handler runs
+	_, err = invokeAs(stub, registrar, "2", "initProperty", []string{"bob", "444455556666", "43", "Pune"})
+	checkCode(err, codeInvalidArgument)
+	_, err = invokeAs(stub, registrar, "2", "subdivideSurvey", []string{"42", "421", "six hundred", "422", "600"})
+	checkCode(err, codeInvalidArgument)
+	_, err = queryAs(stub, auditor, "readSurvey", []string{"42", "43"})
+	checkCode(err, codeInvalidArgument)
+
+	// Reads return plain JSON
+	bytes, err := queryAs(stub, auditor, "readSurvey", []string{"42"})
+	if err != nil {
+		t.Fatalf("readSurvey failed: %s", err)
+	}
+	var survey Survey
+	if err = json.Unmarshal(bytes, &survey); err != nil || survey.SurveyNo != 42 {
+		t.Fatalf("readSurvey returned %s: %v", bytes, err)
+	}
+	bytes, err = queryAs(stub, auditor, "readOwner", []string{"alice"})
+	if err != nil {
+		t.Fatalf("readOwner failed: %s", err)
+	}
+	var owner Owner
+	if err = json.Unmarshal(bytes, &owner); err != nil || owner.Aadhar != 211122223333 {
+		t.Fatalf("readOwner returned %s: %v", bytes, err)
+	}
+	_, err = queryAs(stub, auditor, "readSurvey", []string{"43"})
+	checkCode(err, codeNotFound)
+	_, err = queryAs(stub, auditor, "readOwner", []string{"bob"})
+	checkCode(err, codeNotFound)
+}
+
+func TestSimulateTransfer(t *testing.T) {
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "1200"})
+	checkInvoke(t, stub, "initProperty", []string{"bob", "444455556666", "43", "Pune", "800"})
+
+	before := make(map[string][]byte)
+	for key, value := range stub.State {
+		before[key] = value
+	}
+
+	admin := map[string]string{"role": "admin"}
+	bytes, err := queryAs(stub, admin, "simulateTransfer", []string{"alice", "42", "bob", "30"})
+	if err != nil {
+		t.Fatalf("simulateTransfer failed: %s", err)
+	}
+	var simulation TransferSimulation
+	if err = json.Unmarshal(bytes, &simulation); err != nil {
+		t.Fatalf("simulateTransfer returned %s: %s", bytes, err)
+	}
+	if !reflect.DeepEqual(simulation.Survey.Shares, map[string]int64{"alice": 70, "bob": 30}) ||
+		!reflect.DeepEqual(simulation.Buyer.SurveyNos, []int64{43, 42}) || simulation.Seller.Name != "alice" {
+		t.Fatalf("Unexpected simulation %s", bytes)
+	}
+	if !reflect.DeepEqual(stub.State, before) {
+		t.Fatalf("simulateTransfer changed the state")
+	}
+
+	// An unknown survey is reported instead of panicking
+	if _, err = queryAs(stub, admin, "simulateTransfer", []string{"alice", "44", "bob"}); err == nil {
+		t.Fatalf("Simulated a transfer of an unknown survey")
+	}
+}
+
+func TestBulkImportAndExport(t *testing.T) {
+	stub := newRegistryStub(t)
+	checkInvoke(t, stub, "initProperty", []string{"alice", "211122223333", "42", "Pune", "1200"})
+
+	// One bad record rejects the whole batch
+	rejected := `[
+		{"name": "bob", "aadhar": 444455556666, "surveyNo": 43, "location": "Pune", "area": 800},
+		{"name": "carol", "aadhar": 777788889999, "surveyNo": 43, "location": "Pune", "area": 600},
+		{"name": "dave", "aadhar": 444455556666, "surveyNo": 44, "location": "Pune", "area": 600},
+		{"name": "erin", "aadhar": 12, "surveyNo": 45, "location": "Pune", "area": 600}
+	]`
+	_, err := invokeAs(stub, registrar, "2", "bulkInitProperties", []string{rejected})
+	registryErr, ok := err.(*RegistryError)
+	if !ok || registryErr.Code != codeRecordsRejected || len(registryErr.Records) != 3 {
+		t.Fatalf("Unexpected bulk error %v", err)
+	}
+	if r := registryErr.Records; r[0].Index != 1 || r[0].Code != codeAlreadyExists || r[1].Index != 2 || r[2].Code != codeInvalidArgument {
+		t.Fatalf("Unexpected record errors %+v", r)
+	}
+	if _, ok := stub.State[ownerKey("bob")]; ok {
+		t.Fatalf("Rejected batch was partly stored")
+	}
+
+	// Rejections that agree give their code to the whole batch
+	duplicates := `[
+		{"name": "bob", "aadhar": 444455556666, "surveyNo": 42, "location": "Pune", "area": 800},
+		{"name": "carol", "aadhar": 777788889999, "surveyNo": 42, "location": "Pune", "area": 600}
+	]`
+	_, err = invokeAs(stub, registrar, "2", "bulkInitProperties", []string{duplicates})
+	if registryErr, ok = err.(*RegistryError); !ok || registryErr.Code != codeAlreadyExists || len(registryErr.Records) != 2 {
+		t.Fatalf("Unexpected bulk error %v", err)
+	}
+
+	accepted := `[
+		{"name": "bob", "aadhar": 444455556666, "surveyNo": 43, "location": "Pune", "area": 800},
+		{"name": "bob", "aadhar": 444455556666, "surveyNo": 44, "location": "Nashik", "area": 600},
+		{"name": "alice", "aadhar": 211122223333, "surveyNo": 45, "location": "Pune", "area": 300}
+	]`
+	if _, err = invokeAs(stub, registrar, "3", "bulkInitProperties", []string{accepted}); err != nil {
+		t.Fatalf("bulkInitProperties failed: %s", err)
+	}
+	if bob := loadOwner(t, stub, "bob"); !reflect.DeepEqual(bob.SurveyNos, []int64{43, 44}) {
+		t.Fatalf("bob holds %v", bob.SurveyNos)
+	}
+	if alice := loadOwner(t, stub, "alice"); !reflect.DeepEqual(alice.SurveyNos, []int64{42, 45}) {
+		t.Fatalf("alice holds %v", alice.SurveyNos)
+	}
+	if string(stub.State[aadharKey(444455556666)]) != "bob" || stub.State[locationKey("Nashik", 44)] == nil {
+		t.Fatalf("Index entries not stored")
+	}
+
+	// The export pages through 2 owners and then 4 surveys
+	var exported []ExportRecord
+	start := ""
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("exportRegistry does not terminate")
+		}
+		bytes, err := queryAs(stub, auditor, "exportRegistry", []string{start, "2"})
+		if err != nil {
+			t.Fatalf("exportRegistry failed: %s", err)
+		}
+		var page ExportPage
+		if err = json.Unmarshal(bytes, &page); err != nil {
+			t.Fatalf("exportRegistry returned %s: %s", bytes, err)
+		}
+		exported = append(exported, page.Records...)
+		if !page.HasMore {
+			break
+		}
+		start = page.NextStart
+	}
+	if len(exported) != 6 || exported[0].Owner.Name != "alice" || exported[1].Owner.Name != "bob" ||
+		exported[2].Survey.SurveyNo != 42 || exported[5].Survey.SurveyNo != 45 {
+		t.Fatalf("Unexpected export %+v", exported)
+	}
+}
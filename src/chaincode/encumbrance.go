@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Prefix of the encumbrances of a survey. The number of encumbrances ever
+// registered against a survey is kept under encumbrancePrefix+<surveyNo> and
+// encumbrance i under encumbrancePrefix+<surveyNo>~<i>.
+var encumbrancePrefix = "encumbrance" + keySeparator
+
+// Kinds of encumbrance
+const (
+	encumbranceMortgage  = "mortgage"
+	encumbranceLien      = "lien"
+	encumbranceCourtStay = "courtStay"
+)
+
+// Encumbrance struct stores a mortgage, lien or court stay against a survey.
+// While it is active the survey only changes hands with the holder's consent.
+type Encumbrance struct {
+	SurveyNo     int64  `json:"surveyNo"`
+	Seq          int64  `json:"seq"`
+	Type         string `json:"type"`
+	Holder       string `json:"holder"`    // bank, creditor or court
+	Amount       int64  `json:"amount"`    // amount secured, 0 for a court stay
+	Reference    string `json:"reference"` // loan account, case number, ...
+	Active       bool   `json:"active"`
+	ConsentTo    string `json:"consentTo"` // buyer the holder allows the next transfer to
+	RegisteredTx string `json:"registeredTx"`
+	ReleasedTx   string `json:"releasedTx"`
+}
+
+func encumbranceCountKey(surveyNo int64) string {
+	return encumbrancePrefix + padSurveyNo(surveyNo)
+}
+
+func encumbranceKey(surveyNo int64, seq int64) string {
+	return encumbranceCountKey(surveyNo) + keySeparator + strconv.FormatInt(seq, 10)
+}
+
+// getEncumbranceCount : number of encumbrances ever registered against a survey
+func getEncumbranceCount(stub shim.ChaincodeStubInterface, surveyNo int64) (int64, error) {
+	countAsBytes, err := stub.GetState(encumbranceCountKey(surveyNo))
+	if err != nil {
+		return 0, errInternal("Failed to get encumbrances of survey %d: %s", surveyNo, err)
+	}
+	if countAsBytes == nil {
+		return 0, nil
+	}
+	count, err := strconv.ParseInt(string(countAsBytes), 10, 64)
+	if err != nil {
+		return 0, errInternal("Corrupt encumbrances of survey %d: %s", surveyNo, err)
+	}
+	return count, nil
+}
+
+// getEncumbrance : fetches an encumbrance by survey and sequence number
+func getEncumbrance(stub shim.ChaincodeStubInterface, surveyNo int64, seq int64) (Encumbrance, error) {
+	var encumbrance Encumbrance
+	encumbranceAsBytes, err := stub.GetState(encumbranceKey(surveyNo, seq))
+	if err != nil {
+		return encumbrance, errInternal("Failed to get encumbrance %d of survey %d: %s", seq, surveyNo, err)
+	}
+	if encumbranceAsBytes == nil {
+		return encumbrance, errNotFound("Encumbrance %d of survey %d doesn't exist", seq, surveyNo)
+	}
+	if err = json.Unmarshal(encumbranceAsBytes, &encumbrance); err != nil {
+		return encumbrance, errInternal("Failed to decode encumbrance %d of survey %d: %s", seq, surveyNo, err)
+	}
+	return encumbrance, nil
+}
+
+// putEncumbrance : writes an encumbrance under its survey and sequence number
+func putEncumbrance(stub shim.ChaincodeStubInterface, encumbrance Encumbrance) error {
+	bytes, err := json.Marshal(encumbrance)
+	if err != nil {
+		return errInternal("Failed to encode encumbrance %d of survey %d: %s", encumbrance.Seq, encumbrance.SurveyNo, err)
+	}
+	if err = stub.PutState(encumbranceKey(encumbrance.SurveyNo, encumbrance.Seq), bytes); err != nil {
+		return errInternal("Failed to put encumbrance %d of survey %d: %s", encumbrance.Seq, encumbrance.SurveyNo, err)
+	}
+	return nil
+}
+
+// encumbrancesBySeq sorts encumbrances oldest first
+type encumbrancesBySeq []Encumbrance
+
+func (e encumbrancesBySeq) Len() int           { return len(e) }
+func (e encumbrancesBySeq) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e encumbrancesBySeq) Less(i, j int) bool { return e[i].Seq < e[j].Seq }
+
+// listEncumbrances : all encumbrances of a survey, oldest first. They are
+// read with one range query; the sequence numbers are not padded, so the
+// encumbrances are sorted once decoded.
+func listEncumbrances(stub shim.ChaincodeStubInterface, surveyNo int64, activeOnly bool) ([]Encumbrance, error) {
+	count, err := getEncumbranceCount(stub, surveyNo)
+	if err != nil {
+		return nil, err
+	}
+	encumbrances := []Encumbrance{}
+	if count == 0 {
+		return encumbrances, nil
+	}
+
+	entries, _, err := scanPage(stub, encumbranceCountKey(surveyNo)+keySeparator, "", int(count))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(entries)) != count {
+		return nil, errInternal("Corrupt encumbrances of survey %d: %d of %d found", surveyNo, len(entries), count)
+	}
+	all := make([]Encumbrance, len(entries))
+	for i, entry := range entries {
+		if err = json.Unmarshal(entry.value, &all[i]); err != nil {
+			return nil, errInternal("Failed to decode %s: %s", entry.key, err)
+		}
+	}
+	sort.Sort(encumbrancesBySeq(all))
+
+	for _, encumbrance := range all {
+		if encumbrance.Active || !activeOnly {
+			encumbrances = append(encumbrances, encumbrance)
+		}
+	}
+	return encumbrances, nil
+}
+
+// encumbranceArgs : the survey and sequence number naming an encumbrance
+type encumbranceArgs struct {
+	SurveyNo int64 `arg:"surveyNo"`
+	Seq      int64 `arg:"seq"`
+}
+
+// check : validates the survey and sequence number
+func (args encumbranceArgs) check() error {
+	if err := checkSurveyNo(args.SurveyNo); err != nil {
+		return err
+	}
+	return checkNonNegative("Encumbrance number", args.Seq)
+}
+
+// registerEncumbranceArgs : arguments of registerEncumbrance
+type registerEncumbranceArgs struct {
+	SurveyNo  int64  `arg:"surveyNo"`
+	Type      string `arg:"type"`
+	Holder    string `arg:"holder"`
+	Amount    int64  `arg:"amount"`
+	Reference string `arg:"reference"`
+}
+
+// registerEncumbrance : registers a mortgage, lien or court stay against a
+// survey. Expects survey number, type, holder, amount and reference.
+func (t *SimpleChaincode) registerEncumbrance(stub shim.ChaincodeStubInterface, args registerEncumbranceArgs) (*Encumbrance, error) {
+	surveyNo := args.SurveyNo
+	if err := checkSurveyNo(surveyNo); err != nil {
+		return nil, err
+	}
+	kind := args.Type
+	if kind != encumbranceMortgage && kind != encumbranceLien && kind != encumbranceCourtStay {
+		return nil, errInvalidArgument("Encumbrance type must be one of %s, %s or %s", encumbranceMortgage, encumbranceLien, encumbranceCourtStay)
+	}
+	if err := checkName("Encumbrance holder", args.Holder); err != nil {
+		return nil, err
+	}
+	if err := checkNonNegative("Amount", args.Amount); err != nil {
+		return nil, err
+	}
+
+	survey, err := getActiveSurvey(stub, surveyNo)
+	if err != nil {
+		return nil, err
+	}
+	count, err := getEncumbranceCount(stub, surveyNo)
+	if err != nil {
+		return nil, err
+	}
+
+	encumbrance := Encumbrance{
+		SurveyNo:     surveyNo,
+		Seq:          count,
+		Type:         kind,
+		Holder:       args.Holder,
+		Amount:       args.Amount,
+		Reference:    args.Reference,
+		Active:       true,
+		RegisteredTx: stub.GetTxID(),
+	}
+	survey.Encumbrances++
+
+	if err = putEncumbrance(stub, encumbrance); err != nil {
+		return nil, err
+	}
+	if err = stub.PutState(encumbranceCountKey(surveyNo), []byte(strconv.FormatInt(count+1, 10))); err != nil {
+		return nil, errInternal("Failed to put encumbrances of survey %d: %s", surveyNo, err)
+	}
+	if err = putSurvey(stub, survey); err != nil {
+		return nil, err
+	}
+
+	return &encumbrance, nil
+}
+
+// releaseEncumbrance : discharges an encumbrance. Expects survey number and
+// encumbrance number.
+func (t *SimpleChaincode) releaseEncumbrance(stub shim.ChaincodeStubInterface, args encumbranceArgs) error {
+	if err := args.check(); err != nil {
+		return err
+	}
+
+	encumbrance, err := getEncumbrance(stub, args.SurveyNo, args.Seq)
+	if err != nil {
+		return err
+	}
+	if !encumbrance.Active {
+		return errFailedPrecondition("Encumbrance %d of survey %d is already released", args.Seq, args.SurveyNo)
+	}
+	survey, err := getSurvey(stub, args.SurveyNo)
+	if err != nil {
+		return err
+	}
+
+	encumbrance.Active = false
+	encumbrance.ConsentTo = ""
+	encumbrance.ReleasedTx = stub.GetTxID()
+	survey.Encumbrances--
+
+	if err = putEncumbrance(stub, encumbrance); err != nil {
+		return err
+	}
+	return putSurvey(stub, survey)
+}
+
+// consentArgs : arguments of consentTransfer
+type consentArgs struct {
+	SurveyNo int64  `arg:"surveyNo"`
+	Seq      int64  `arg:"seq"`
+	Buyer    string `arg:"buyer"`
+}
+
+// consentTransfer : the holder of an encumbrance allows the next transfer of
+// the survey to a buyer. Expects survey number, encumbrance number and buyer.
+func (t *SimpleChaincode) consentTransfer(stub shim.ChaincodeStubInterface, args consentArgs) error {
+	if err := (encumbranceArgs{args.SurveyNo, args.Seq}).check(); err != nil {
+		return err
+	}
+
+	encumbrance, err := getEncumbrance(stub, args.SurveyNo, args.Seq)
+	if err != nil {
+		return err
+	}
+	if !encumbrance.Active {
+		return errFailedPrecondition("Encumbrance %d of survey %d is already released", args.Seq, args.SurveyNo)
+	}
+	if _, err = getOwner(stub, args.Buyer); err != nil {
+		return err
+	}
+
+	encumbrance.ConsentTo = args.Buyer
+	return putEncumbrance(stub, encumbrance)
+}
+
+// checkEncumbrances : fails unless the holder of every active encumbrance of
+// the survey has consented to a transfer to the buyer. The consents are
+// returned cleared, to be written back once the transfer is made.
+func checkEncumbrances(stub shim.ChaincodeStubInterface, survey Survey, buyer string) ([]Encumbrance, error) {
+	if survey.Encumbrances == 0 {
+		return nil, nil
+	}
+	encumbrances, err := listEncumbrances(stub, survey.SurveyNo, true)
+	if err != nil {
+		return nil, err
+	}
+	for i := range encumbrances {
+		if encumbrances[i].ConsentTo != buyer {
+			return nil, errFailedPrecondition("Survey %d is under a %s held by %s, who has not consented to a transfer to %s",
+				survey.SurveyNo, encumbrances[i].Type, encumbrances[i].Holder, buyer)
+		}
+		encumbrances[i].ConsentTo = ""
+	}
+	return encumbrances, nil
+}
+
+// readEncumbrancesArgs : arguments of readEncumbrances
+type readEncumbrancesArgs struct {
+	SurveyNo int64  `arg:"surveyNo"`
+	Filter   string `arg:"filter,optional"`
+}
+
+// readEncumbrances : lists the encumbrances of a survey. Expects the survey
+// number and optionally "active" to leave out released encumbrances.
+func (t *SimpleChaincode) readEncumbrances(stub shim.ChaincodeStubInterface, args readEncumbrancesArgs) ([]Encumbrance, error) {
+	if err := checkSurveyNo(args.SurveyNo); err != nil {
+		return nil, err
+	}
+	if args.Filter != "" && args.Filter != "active" {
+		return nil, errInvalidArgument("Filter must be \"active\"")
+	}
+
+	if _, err := getSurvey(stub, args.SurveyNo); err != nil {
+		return nil, err
+	}
+	return listEncumbrances(stub, args.SurveyNo, args.Filter == "active")
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Error codes returned to clients in RegistryError.Code
+const (
+	codeInvalidArgument    = "INVALID_ARGUMENT"    // malformed or missing argument
+	codeNotFound           = "NOT_FOUND"           // owner, survey, sale, ... is not registered
+	codeAlreadyExists      = "ALREADY_EXISTS"      // owner, survey, sale, ... is already registered
+	codeFailedPrecondition = "FAILED_PRECONDITION" // state of the registry does not allow the call
+	codeUnknownFunction    = "UNKNOWN_FUNCTION"
+	codeUnauthenticated    = "UNAUTHENTICATED"
+	codeAccessDenied       = "ACCESS_DENIED"
+	codeInternal           = "INTERNAL"         // failure reading or writing the state
+	codeRecordsRejected    = "RECORDS_REJECTED" // records of a bulk call rejected with different codes, see Records
+)
+
+// RegistryError is a structured error. Its message is the JSON encoding of
+// the struct so that clients can act on the code instead of parsing text.
+type RegistryError struct {
+	Code     string `json:"code"`
+	Function string `json:"function,omitempty"`
+	Message  string `json:"message"`
+
+	// Records lists the rejected records of a bulk call
+	Records []RecordError `json:"records,omitempty"`
+}
+
+func (e *RegistryError) Error() string {
+	bytes, err := json.Marshal(e)
+	if err != nil {
+		return e.Code + ": " + e.Message
+	}
+	return string(bytes)
+}
+
+// newRegistryError : builds a RegistryError with a formatted message
+func newRegistryError(code string, function string, format string, args ...interface{}) *RegistryError {
+	return &RegistryError{Code: code, Function: function, Message: fmt.Sprintf(format, args...)}
+}
+
+func errInvalidArgument(format string, args ...interface{}) error {
+	return newRegistryError(codeInvalidArgument, "", format, args...)
+}
+
+func errNotFound(format string, args ...interface{}) error {
+	return newRegistryError(codeNotFound, "", format, args...)
+}
+
+func errAlreadyExists(format string, args ...interface{}) error {
+	return newRegistryError(codeAlreadyExists, "", format, args...)
+}
+
+func errFailedPrecondition(format string, args ...interface{}) error {
+	return newRegistryError(codeFailedPrecondition, "", format, args...)
+}
+
+func errInternal(format string, args ...interface{}) error {
+	return newRegistryError(codeInternal, "", format, args...)
+}
+
+// errorMessage : the message of an error without its code
+func errorMessage(err error) string {
+	if registryErr, ok := err.(*RegistryError); ok {
+		return registryErr.Message
+	}
+	return err.Error()
+}
+
+// inFunction : stamps the function called on the error returned to the
+// client. The router's errors keep their code, any other error that is not
+// a RegistryError is reported as internal.
+func inFunction(function string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if routeErr, ok := err.(*shim.RouteError); ok {
+		return newRegistryError(routeErr.Code, function, "%s", routeErr.Message)
+	}
+	registryErr, ok := err.(*RegistryError)
+	if !ok {
+		return newRegistryError(codeInternal, function, "%s", err)
+	}
+	if registryErr.Function == "" {
+		registryErr.Function = function
+	}
+	return registryErr
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Prefix of the per-survey ownership history. The number of records of a
+// survey is kept under historyPrefix+<surveyNo> and record i under
+// historyPrefix+<surveyNo>~<i>.
+var historyPrefix = "history" + keySeparator
+
+// TransferRecord struct stores a single change of hands of a survey. The
+// registration of a survey is recorded with an empty seller.
+type TransferRecord struct {
+	Seq      int64  `json:"seq"`
+	SurveyNo int64  `json:"surveyNo"`
+	Seller   string `json:"seller"`
+	Buyer    string `json:"buyer"`
+	Share    int64  `json:"share"`
+	TxID     string `json:"txID"`
+	Time     string `json:"time"`
+}
+
+// HistoryPage struct is the response of readSurveyHistory
+type HistoryPage struct {
+	Records   []TransferRecord `json:"records"`
+	NextStart int64            `json:"nextStart"`
+	HasMore   bool             `json:"hasMore"`
+}
+
+func historyCountKey(surveyNo int64) string {
+	return historyPrefix + strconv.FormatInt(surveyNo, 10)
+}
+
+func historyRecordKey(surveyNo int64, seq int64) string {
+	return historyCountKey(surveyNo) + keySeparator + strconv.FormatInt(seq, 10)
+}
+
+// getHistoryCount : number of transfer records stored for a survey
+func getHistoryCount(stub shim.ChaincodeStubInterface, surveyNo int64) (int64, error) {
+	countAsBytes, err := stub.GetState(historyCountKey(surveyNo))
+	if err != nil {
+		return 0, errInternal("Failed to get history of survey %d: %s", surveyNo, err)
+	}
+	if countAsBytes == nil {
+		return 0, nil
+	}
+	count, err := strconv.ParseInt(string(countAsBytes), 10, 64)
+	if err != nil {
+		return 0, errInternal("Corrupt history of survey %d: %s", surveyNo, err)
+	}
+	return count, nil
+}
+
+// appendTransferRecord : adds a record to the end of a survey's history,
+// stamping it with the current transaction ID and time
+func appendTransferRecord(stub shim.ChaincodeStubInterface, surveyNo int64, seller string, buyer string, share int64) error {
+	count, err := getHistoryCount(stub, surveyNo)
+	if err != nil {
+		return err
+	}
+
+	record := TransferRecord{
+		Seq:      count,
+		SurveyNo: surveyNo,
+		Seller:   seller,
+		Buyer:    buyer,
+		Share:    share,
+		TxID:     stub.GetTxID(),
+	}
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return errInternal("Failed to get transaction time: %s", err)
+	}
+	if ts != nil {
+		record.Time = time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339Nano)
+	}
+
+	bytes, err := json.Marshal(record)
+	if err != nil {
+		return errInternal("Failed to encode history of survey %d: %s", surveyNo, err)
+	}
+	if err = stub.PutState(historyRecordKey(surveyNo, count), bytes); err != nil {
+		return errInternal("Failed to put history of survey %d: %s", surveyNo, err)
+	}
+	if err = stub.PutState(historyCountKey(surveyNo), []byte(strconv.FormatInt(count+1, 10))); err != nil {
+		return errInternal("Failed to put history of survey %d: %s", surveyNo, err)
+	}
+	return nil
+}
+
+// historyArgs : arguments of readSurveyHistory
+type historyArgs struct {
+	SurveyNo int64 `arg:"surveyNo"`
+	Start    int64 `arg:"start,optional"`
+	Limit    int   `arg:"limit,optional"`
+}
+
+// readSurveyHistory : returns the title chain of a survey, oldest first.
+// Expects the survey number and optionally the first record and page size.
+func (t *SimpleChaincode) readSurveyHistory(stub shim.ChaincodeStubInterface, args historyArgs) (*HistoryPage, error) {
+	surveyNo, start := args.SurveyNo, args.Start
+	if err := checkSurveyNo(surveyNo); err != nil {
+		return nil, err
+	}
+	if err := checkNonNegative("Start", start); err != nil {
+		return nil, err
+	}
+	pageSize, err := pageLimit(args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	limit := int64(pageSize)
+
+	if _, err = getSurvey(stub, surveyNo); err != nil {
+		return nil, err
+	}
+	count, err := getHistoryCount(stub, surveyNo)
+	if err != nil {
+		return nil, err
+	}
+
+	// The records of the page are read in one round trip
+	var keys []string
+	for seq := start; seq < count && seq < start+limit; seq++ {
+		keys = append(keys, historyRecordKey(surveyNo, seq))
+	}
+	page := HistoryPage{Records: []TransferRecord{}}
+	if len(keys) != 0 {
+		values, err := stub.GetStateMultiple(keys)
+		if err != nil {
+			return nil, errInternal("Failed to get history of survey %d: %s", surveyNo, err)
+		}
+		for i, recordAsBytes := range values {
+			if recordAsBytes == nil {
+				return nil, errInternal("History record %d of survey %d is missing", start+int64(i), surveyNo)
+			}
+			var record TransferRecord
+			if err = json.Unmarshal(recordAsBytes, &record); err != nil {
+				return nil, errInternal("Corrupt history of survey %d: %s", surveyNo, err)
+			}
+			page.Records = append(page.Records, record)
+		}
+	}
+	page.NextStart = start + int64(len(page.Records))
+	page.HasMore = page.NextStart < count
+
+	return &page, nil
+}
+
+// SurveyVersion struct is a version of a survey as committed in a block of
+// the ledger, with the transactions of the block that wrote the survey
+type SurveyVersion struct {
+	BlockNumber uint64   `json:"blockNumber"`
+	TxIDs       []string `json:"txIDs"`
+	Deleted     bool     `json:"deleted"`
+	Survey      *Survey  `json:"survey,omitempty"`
+}
+
+// surveyAsOfArgs : arguments of readSurveyAsOf
+type surveyAsOfArgs struct {
+	SurveyNo    int64  `arg:"surveyNo"`
+	BlockNumber uint64 `arg:"blockNumber"`
+}
+
+// decodeSurvey : decodes a survey read from the ledger
+func decodeSurvey(surveyNo int64, surveyAsBytes []byte) (*Survey, error) {
+	var survey Survey
+	if err := json.Unmarshal(surveyAsBytes, &survey); err != nil {
+		return nil, errInternal("Failed to decode survey %d: %s", surveyNo, err)
+	}
+	normalizeShares(&survey)
+	return &survey, nil
+}
+
+// readSurveyAsOf : returns a survey as it was once a block was committed.
+// Expects the survey number and the block number. Only blocks whose state
+// deltas the peer still keeps can be read.
+func (t *SimpleChaincode) readSurveyAsOf(stub shim.ChaincodeStubInterface, args surveyAsOfArgs) (*Survey, error) {
+	if err := checkSurveyNo(args.SurveyNo); err != nil {
+		return nil, err
+	}
+
+	surveyAsBytes, err := stub.GetStateAsOf(surveyKey(args.SurveyNo), args.BlockNumber)
+	if err != nil {
+		return nil, errFailedPrecondition("Failed to get survey %d as of block %d: %s", args.SurveyNo, args.BlockNumber, err)
+	}
+	if surveyAsBytes == nil {
+		return nil, errNotFound("Survey number %d didn't exist at block %d", args.SurveyNo, args.BlockNumber)
+	}
+	return decodeSurvey(args.SurveyNo, surveyAsBytes)
+}
+
+// readSurveyVersions : returns the committed versions of a survey, oldest
+// first, as far back as the peer keeps state deltas. Unlike
+// readSurveyHistory, which lists transfers, it lists every change to the
+// survey record. Expects the survey number.
+func (t *SimpleChaincode) readSurveyVersions(stub shim.ChaincodeStubInterface, args surveyArgs) ([]SurveyVersion, error) {
+	if err := checkSurveyNo(args.SurveyNo); err != nil {
+		return nil, err
+	}
+
+	modifications, err := stub.GetHistoryForKey(surveyKey(args.SurveyNo))
+	if err != nil {
+		return nil, errInternal("Failed to get versions of survey %d: %s", args.SurveyNo, err)
+	}
+	versions := []SurveyVersion{}
+	for _, modification := range modifications {
+		version := SurveyVersion{BlockNumber: modification.BlockNumber, TxIDs: modification.TxIDs, Deleted: modification.IsDelete}
+		if !modification.IsDelete {
+			if version.Survey, err = decodeSurvey(args.SurveyNo, modification.Value); err != nil {
+				return nil, err
+			}
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
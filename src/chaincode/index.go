@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Owners, surveys and their secondary indexes live under prefix-structured
+// keys so that listings are served by range queries instead of index arrays.
+//
+//	owner~<name>                    Owner document
+//	survey~<surveyNo>               Survey document
+//	aadhar~<aadhar>                 name of the owner holding the Aadhar number
+//	location~<location>~<surveyNo>  survey number, one entry per survey
+//
+// Survey numbers are zero padded so that surveys list in numeric order.
+var keySeparator = "~"
+var ownerPrefix = "owner" + keySeparator
+var surveyPrefix = "survey" + keySeparator
+var aadharPrefix = "aadhar" + keySeparator
+var locationPrefix = "location" + keySeparator
+
+// Page size limits of the paginated queries
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+// rangeEnd sorts after every key starting with the prefix it is appended to
+var rangeEnd = string(utf8.MaxRune)
+
+func ownerKey(name string) string {
+	return ownerPrefix + name
+}
+
+func surveyKey(surveyNo int64) string {
+	return surveyPrefix + padSurveyNo(surveyNo)
+}
+
+func aadharKey(aadhar int64) string {
+	return aadharPrefix + strconv.FormatInt(aadhar, 10)
+}
+
+func locationKey(location string, surveyNo int64) string {
+	return locationPrefix + location + keySeparator + padSurveyNo(surveyNo)
+}
+
+func padSurveyNo(surveyNo int64) string {
+	return fmt.Sprintf("%019d", surveyNo)
+}
+
+// surveyNoOfKey : the survey number a padded key ends with
+func surveyNoOfKey(key string, prefix string) int64 {
+	surveyNo, _ := strconv.ParseInt(strings.TrimPrefix(key, prefix), 10, 64)
+	return surveyNo
+}
+
+// OwnerPage struct is the response of readOwnerIndex
+type OwnerPage struct {
+	Owners    []Owner `json:"owners"`
+	NextStart string  `json:"nextStart"`
+	HasMore   bool    `json:"hasMore"`
+}
+
+// SurveyPage struct is the response of readSurveyIndex and readSurveysByLocation
+type SurveyPage struct {
+	Surveys   []Survey `json:"surveys"`
+	NextStart string   `json:"nextStart"`
+	HasMore   bool     `json:"hasMore"`
+}
+
+// kv is a key and value read by scanPage
+type kv struct {
+	key   string
+	value []byte
+}
+
+// kvsByKey sorts key-values in lexical order of their keys
+type kvsByKey []kv
+
+func (kvs kvsByKey) Len() int           { return len(kvs) }
+func (kvs kvsByKey) Swap(i, j int)      { kvs[i], kvs[j] = kvs[j], kvs[i] }
+func (kvs kvsByKey) Less(i, j int) bool { return kvs[i].key < kvs[j].key }
+
+// scanPage : reads the first limit keys, in lexical order, that start with
+// prefix and are not before prefix+start, and the key following them,
+// returned as next. A peer that pages range queries reads only those keys. A
+// peer without paging, such as the Bluemix v0.6 peer, ignores the page size
+// and returns the whole range in the order of its state store, so the keys
+// are sorted here and the page is cut from them; the listing is then right,
+// but each call reads the whole range.
+func scanPage(stub shim.ChaincodeStubInterface, prefix string, start string, limit int) ([]kv, *kv, error) {
+	iter, _, err := stub.RangeQueryStatePage(prefix+start, prefix+rangeEnd, limit+1, "")
+	if err != nil {
+		return nil, nil, errInternal("Failed to query range %s: %s", prefix, err)
+	}
+	defer iter.Close()
+
+	var page []kv
+	for iter.HasNext() {
+		key, value, err := iter.Next()
+		if err != nil {
+			return nil, nil, errInternal("Failed to query range %s: %s", prefix, err)
+		}
+		page = append(page, kv{key, value})
+	}
+	sort.Sort(kvsByKey(page))
+	if len(page) > limit+1 {
+		page = page[:limit+1]
+	}
+
+	if len(page) > limit {
+		return page[:limit], &page[limit], nil
+	}
+	return page, nil, nil
+}
+
+// pageArgs : the optional start and limit arguments of a listing
+type pageArgs struct {
+	Start string `arg:"start,optional"`
+	Limit int    `arg:"limit,optional"`
+}
+
+// locationPageArgs : arguments of readSurveysByLocation
+type locationPageArgs struct {
+	Location string `arg:"location"`
+	Start    string `arg:"start,optional"`
+	Limit    int    `arg:"limit,optional"`
+}
+
+// surveyArgs : arguments naming a survey
+type surveyArgs struct {
+	SurveyNo int64 `arg:"surveyNo"`
+}
+
+// pageLimit : the page size of a listing, defaultPageLimit if not given
+func pageLimit(limit int) (int, error) {
+	if limit == 0 {
+		return defaultPageLimit, nil
+	}
+	if limit < 0 || limit > maxPageLimit {
+		return 0, errInvalidArgument("Limit must be between 1 and %d", maxPageLimit)
+	}
+	return limit, nil
+}
+
+// surveyStart : converts the start of a survey listing to its key suffix
+func surveyStart(start string) (string, error) {
+	if start == "" {
+		return "", nil
+	}
+	surveyNo, err := strconv.ParseInt(start, 10, 64)
+	if err != nil {
+		return "", errInvalidArgument("Start must be a survey number")
+	}
+	return padSurveyNo(surveyNo), nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// getActiveSurvey : fetches a survey, failing if it has been retired by a
+// subdivision or merger
+func getActiveSurvey(stub shim.ChaincodeStubInterface, surveyNo int64) (Survey, error) {
+	survey, err := getSurvey(stub, surveyNo)
+	if err == nil && survey.Retired {
+		err = errFailedPrecondition("Survey %d is retired, see surveys %v", surveyNo, survey.Children)
+	}
+	return survey, err
+}
+
+// checkNewSurveyNo : fails unless a survey number is unused
+func checkNewSurveyNo(stub shim.ChaincodeStubInterface, surveyNo int64) error {
+	_, exists, err := findSurvey(stub, surveyNo)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errAlreadyExists("Survey %d already exists", surveyNo)
+	}
+	return nil
+}
+
+// replaceSurveyNos : updates the survey numbers of the named owners, replacing
+// the retired surveys by the new ones, and returns them to be put
+func replaceSurveyNos(stub shim.ChaincodeStubInterface, names []string, retired []int64, created []int64) ([]Owner, error) {
+	var owners []Owner
+	for _, name := range names {
+		owner, err := getOwner(stub, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, surveyNo := range retired {
+			owner.SurveyNos = removeSurveyNo(owner.SurveyNos, surveyNo)
+		}
+		owner.SurveyNos = append(owner.SurveyNos, created...)
+		owners = append(owners, owner)
+	}
+	return owners, nil
+}
+
+// replaceAdjacent : updates the surveys adjacent to the retired ones,
+// replacing the retired surveys by the new ones, and returns them to be put
+func replaceAdjacent(stub shim.ChaincodeStubInterface, retired []Survey, created []int64) ([]Survey, error) {
+	var retiredNos, neighbourNos []int64
+	for _, survey := range retired {
+		retiredNos = append(retiredNos, survey.SurveyNo)
+	}
+	for _, survey := range retired {
+		for _, surveyNo := range survey.Adjacent {
+			if indexOfSurveyNo(retiredNos, surveyNo) == -1 && indexOfSurveyNo(neighbourNos, surveyNo) == -1 {
+				neighbourNos = append(neighbourNos, surveyNo)
+			}
+		}
+	}
+
+	var neighbours []Survey
+	for _, surveyNo := range neighbourNos {
+		neighbour, err := getSurvey(stub, surveyNo)
+		if err != nil {
+			return nil, err
+		}
+		for _, retiredNo := range retiredNos {
+			neighbour.Adjacent = removeSurveyNo(neighbour.Adjacent, retiredNo)
+		}
+		neighbour.Adjacent = append(neighbour.Adjacent, created...)
+		neighbours = append(neighbours, neighbour)
+	}
+	return neighbours, nil
+}
+
+// checkConnected : fails unless the surveys are connected through the
+// adjacency recorded between them
+func checkConnected(surveys []Survey) error {
+	surveyNos := make([]int64, len(surveys))
+	for i, survey := range surveys {
+		surveyNos[i] = survey.SurveyNo
+	}
+	reached := []int64{surveyNos[0]}
+	for i := 0; i < len(reached); i++ {
+		survey := surveys[indexOfSurveyNo(surveyNos, reached[i])]
+		for _, surveyNo := range survey.Adjacent {
+			if indexOfSurveyNo(surveyNos, surveyNo) != -1 && indexOfSurveyNo(reached, surveyNo) == -1 {
+				reached = append(reached, surveyNo)
+			}
+		}
+	}
+	for _, surveyNo := range surveyNos {
+		if indexOfSurveyNo(reached, surveyNo) == -1 {
+			return errFailedPrecondition("Survey %d is not recorded as adjacent to the other surveys to merge", surveyNo)
+		}
+	}
+	return nil
+}
+
+// putLineage : writes the surveys, neighbours and owners changed by a
+// subdivision or merger, with the index entries and opening history of the
+// new surveys. The retired surveys leave the location index.
+func putLineage(stub shim.ChaincodeStubInterface, retired []Survey, created []Survey, neighbours []Survey, owners []Owner) error {
+	for _, owner := range owners {
+		if err := putOwner(stub, owner); err != nil {
+			return err
+		}
+	}
+	for _, survey := range neighbours {
+		if err := putSurvey(stub, survey); err != nil {
+			return err
+		}
+	}
+	for _, survey := range retired {
+		if err := putSurvey(stub, survey); err != nil {
+			return err
+		}
+		if err := stub.DelState(locationKey(survey.Location, survey.SurveyNo)); err != nil {
+			return errInternal("Failed to delete location index: %s", err)
+		}
+	}
+	for _, survey := range created {
+		if err := putSurvey(stub, survey); err != nil {
+			return err
+		}
+		err := stub.PutState(locationKey(survey.Location, survey.SurveyNo), []byte(strconv.FormatInt(survey.SurveyNo, 10)))
+		if err != nil {
+			return errInternal("Failed to put location index: %s", err)
+		}
+		for _, name := range survey.Owners {
+			if err = appendTransferRecord(stub, survey.SurveyNo, "", name, survey.Shares[name]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// subdivideArgs : arguments of subdivideSurvey, the children given as a
+// survey number followed by its area
+type subdivideArgs struct {
+	Parent   int64   `arg:"parent"`
+	Children []int64 `arg:"children,rest"`
+}
+
+// subdivideSurvey : splits a survey into child surveys held by the same
+// owners in the same shares. Expects the parent survey number followed by a
+// survey number and area per child; the areas must add up to the parent's.
+// The parent is retired, not deleted. Which children border which, and the
+// parent's neighbours, cannot be told from the areas, so the children start
+// with no adjacency for a registrar to record.
+func (t *SimpleChaincode) subdivideSurvey(stub shim.ChaincodeStubInterface, args subdivideArgs) error {
+	if len(args.Children) < 4 || len(args.Children)%2 != 0 {
+		return errInvalidArgument("Incorrect number of arguments. Expected parent survey number and a survey number and area for at least 2 children")
+	}
+
+	parentNo := args.Parent
+	if err := checkSurveyNo(parentNo); err != nil {
+		return err
+	}
+	parent, err := getActiveSurvey(stub, parentNo)
+	if err != nil {
+		return err
+	}
+	if parent.Encumbrances != 0 {
+		return errFailedPrecondition("Survey %d has active encumbrances and cannot be subdivided", parentNo)
+	}
+	if parent.Escrow != "" {
+		return errFailedPrecondition("Survey %d is held in escrow by sale %s and cannot be subdivided", parentNo, parent.Escrow)
+	}
+
+	var children []Survey
+	var childNos []int64
+	var total int64
+	for i := 0; i < len(args.Children); i += 2 {
+		childNo, area := args.Children[i], args.Children[i+1]
+		if err = checkSurveyNo(childNo); err != nil {
+			return err
+		}
+		if err = checkPositive("Area", area); err != nil {
+			return err
+		}
+		if indexOfSurveyNo(childNos, childNo) != -1 {
+			return errInvalidArgument("Survey %d is listed twice", childNo)
+		}
+		if err = checkNewSurveyNo(stub, childNo); err != nil {
+			return err
+		}
+
+		child := Survey{
+			SurveyNo: childNo,
+			Area:     area,
+			Location: parent.Location,
+			Owners:   append([]string(nil), parent.Owners...),
+			Shares:   make(map[string]int64),
+			Parents:  []int64{parentNo},
+		}
+		for name, share := range parent.Shares {
+			child.Shares[name] = share
+		}
+		children = append(children, child)
+		childNos = append(childNos, childNo)
+		total += area
+	}
+	if total != parent.Area {
+		return errInvalidArgument("Child areas add up to %d, survey %d has area %d", total, parentNo, parent.Area)
+	}
+
+	parent.Retired = true
+	parent.Children = childNos
+
+	owners, err := replaceSurveyNos(stub, parent.Owners, []int64{parentNo}, childNos)
+	if err != nil {
+		return err
+	}
+	neighbours, err := replaceAdjacent(stub, []Survey{parent}, nil)
+	if err != nil {
+		return err
+	}
+	return putLineage(stub, []Survey{parent}, children, neighbours, owners)
+}
+
+// mergeArgs : arguments of mergeSurveys
+type mergeArgs struct {
+	SurveyNo int64   `arg:"surveyNo"`
+	Parents  []int64 `arg:"parents,rest"`
+}
+
+// mergeSurveys : combines adjoining surveys of one location held by the same
+// owners in the same shares into a new survey. Expects the new survey number
+// followed by at least two survey numbers to merge. The surveys carry no
+// boundaries, so they adjoin only as recorded by recordAdjacency, and a merger
+// of surveys not connected that way is rejected. The merged surveys are
+// retired and the new survey borders their neighbours.
+func (t *SimpleChaincode) mergeSurveys(stub shim.ChaincodeStubInterface, args mergeArgs) error {
+	if len(args.Parents) < 2 {
+		return errInvalidArgument("Incorrect number of arguments. Expected new survey number and at least 2 surveys to merge")
+	}
+
+	mergedNo := args.SurveyNo
+	if err := checkSurveyNo(mergedNo); err != nil {
+		return err
+	}
+	if err := checkNewSurveyNo(stub, mergedNo); err != nil {
+		return err
+	}
+
+	var parents []Survey
+	var parentNos []int64
+	merged := Survey{SurveyNo: mergedNo}
+	for _, parentNo := range args.Parents {
+		if err := checkSurveyNo(parentNo); err != nil {
+			return err
+		}
+		if indexOfSurveyNo(parentNos, parentNo) != -1 {
+			return errInvalidArgument("Survey %d is listed twice", parentNo)
+		}
+		parent, err := getActiveSurvey(stub, parentNo)
+		if err != nil {
+			return err
+		}
+		if parent.Encumbrances != 0 {
+			return errFailedPrecondition("Survey %d has active encumbrances and cannot be merged", parentNo)
+		}
+		if parent.Escrow != "" {
+			return errFailedPrecondition("Survey %d is held in escrow by sale %s and cannot be merged", parentNo, parent.Escrow)
+		}
+
+		if len(parents) == 0 {
+			merged.Location = parent.Location
+			merged.Owners = append([]string(nil), parent.Owners...)
+			merged.Shares = parent.Shares
+		} else if parent.Location != merged.Location {
+			return errFailedPrecondition("Survey %d is in %s, not %s", parentNo, parent.Location, merged.Location)
+		} else if !reflect.DeepEqual(parent.Shares, merged.Shares) {
+			return errFailedPrecondition("Survey %d is not held by the same owners in the same shares as survey %d", parentNo, parentNos[0])
+		}
+		merged.Area += parent.Area
+
+		parents = append(parents, parent)
+		parentNos = append(parentNos, parentNo)
+	}
+	if err := checkConnected(parents); err != nil {
+		return err
+	}
+	merged.Parents = parentNos
+
+	owners, err := replaceSurveyNos(stub, merged.Owners, parentNos, []int64{mergedNo})
+	if err != nil {
+		return err
+	}
+	neighbours, err := replaceAdjacent(stub, parents, []int64{mergedNo})
+	if err != nil {
+		return err
+	}
+	for i := range parents {
+		parents[i].Retired = true
+		parents[i].Children = []int64{mergedNo}
+	}
+	for _, neighbour := range neighbours {
+		merged.Adjacent = append(merged.Adjacent, neighbour.SurveyNo)
+	}
+	return putLineage(stub, parents, []Survey{merged}, neighbours, owners)
+}
+
+// adjacencyArgs : arguments of recordAdjacency
+type adjacencyArgs struct {
+	SurveyNo   int64 `arg:"surveyNo"`
+	AdjacentNo int64 `arg:"adjacentNo"`
+}
+
+// recordAdjacency : records that two active surveys of one location share a
+// boundary. Expects the two survey numbers.
+func (t *SimpleChaincode) recordAdjacency(stub shim.ChaincodeStubInterface, args adjacencyArgs) error {
+	if err := checkSurveyNo(args.SurveyNo); err != nil {
+		return err
+	}
+	if err := checkSurveyNo(args.AdjacentNo); err != nil {
+		return err
+	}
+	if args.SurveyNo == args.AdjacentNo {
+		return errInvalidArgument("Survey %d cannot adjoin itself", args.SurveyNo)
+	}
+	survey, err := getActiveSurvey(stub, args.SurveyNo)
+	if err != nil {
+		return err
+	}
+	adjacent, err := getActiveSurvey(stub, args.AdjacentNo)
+	if err != nil {
+		return err
+	}
+	if survey.Location != adjacent.Location {
+		return errFailedPrecondition("Survey %d is in %s, not %s", args.AdjacentNo, adjacent.Location, survey.Location)
+	}
+	if indexOfSurveyNo(survey.Adjacent, args.AdjacentNo) != -1 {
+		return errAlreadyExists("Surveys %d and %d are already recorded as adjacent", args.SurveyNo, args.AdjacentNo)
+	}
+
+	survey.Adjacent = append(survey.Adjacent, args.AdjacentNo)
+	adjacent.Adjacent = append(adjacent.Adjacent, args.SurveyNo)
+	if err = putSurvey(stub, survey); err != nil {
+		return err
+	}
+	return putSurvey(stub, adjacent)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Keys of the index arrays kept by the chaincode before owners and surveys
+// moved to prefixed keys. Owners were then stored under their bare name and
+// surveys under their bare survey number.
+var legacyOwnerIndex = "_ownerIndex"
+var legacySurveyIndex = "_surveyIndex"
+
+// MigrationResult struct is the response of migrateLegacyKeys
+type MigrationResult struct {
+	Owners  int `json:"owners"`
+	Surveys int `json:"surveys"`
+}
+
+// readLegacyIndex : decodes an index array, empty if the state has none
+func readLegacyIndex(stub shim.ChaincodeStubInterface, key string, index interface{}) error {
+	indexAsBytes, err := stub.GetState(key)
+	if err != nil {
+		return errInternal("Failed to get %s: %s", key, err)
+	}
+	if indexAsBytes == nil {
+		return nil
+	}
+	if err = json.Unmarshal(indexAsBytes, index); err != nil {
+		return errInternal("Failed to decode %s: %s", key, err)
+	}
+	return nil
+}
+
+// migrateLegacyKeys : moves the owners and surveys listed in the index arrays
+// of an older deployment from their bare keys to the prefixed keys, adds
+// their Aadhar and location index entries and deletes the arrays. Surveys
+// get their shares on the way. Running it again once done moves nothing.
+func (t *SimpleChaincode) migrateLegacyKeys(stub shim.ChaincodeStubInterface) (MigrationResult, error) {
+	var result MigrationResult
+	var ownerNames []string
+	var surveyNos []int64
+	if err := readLegacyIndex(stub, legacyOwnerIndex, &ownerNames); err != nil {
+		return result, err
+	}
+	if err := readLegacyIndex(stub, legacySurveyIndex, &surveyNos); err != nil {
+		return result, err
+	}
+
+	for _, surveyNo := range surveyNos {
+		legacyKey := strconv.FormatInt(surveyNo, 10)
+		surveyAsBytes, err := stub.GetState(legacyKey)
+		if err != nil {
+			return result, errInternal("Failed to get survey %d: %s", surveyNo, err)
+		}
+		if surveyAsBytes == nil {
+			continue
+		}
+		survey, err := decodeSurvey(surveyNo, surveyAsBytes)
+		if err != nil {
+			return result, err
+		}
+		if _, exists, err := findSurvey(stub, surveyNo); err != nil {
+			return result, err
+		} else if exists {
+			return result, errAlreadyExists("Survey %d already exists", surveyNo)
+		}
+
+		if err = putSurvey(stub, *survey); err != nil {
+			return result, err
+		}
+		err = stub.PutState(locationKey(survey.Location, surveyNo), []byte(legacyKey))
+		if err != nil {
+			return result, errInternal("Failed to put location index: %s", err)
+		}
+		if err = stub.DelState(legacyKey); err != nil {
+			return result, errInternal("Failed to delete survey %d: %s", surveyNo, err)
+		}
+		result.Surveys++
+	}
+
+	for _, name := range ownerNames {
+		ownerAsBytes, err := stub.GetState(name)
+		if err != nil {
+			return result, errInternal("Failed to get owner %s: %s", name, err)
+		}
+		if ownerAsBytes == nil {
+			continue
+		}
+		var owner Owner
+		if err = json.Unmarshal(ownerAsBytes, &owner); err != nil {
+			return result, errInternal("Failed to decode owner %s: %s", name, err)
+		}
+		if _, exists, err := findOwner(stub, name); err != nil {
+			return result, err
+		} else if exists {
+			return result, errAlreadyExists("Owner %s already exists", name)
+		}
+		holderAsBytes, err := stub.GetState(aadharKey(owner.Aadhar))
+		if err != nil {
+			return result, errInternal("Failed to get Aadhar index: %s", err)
+		}
+		if holderAsBytes != nil {
+			return result, errAlreadyExists("Aadhar number %d is already registered to %s", owner.Aadhar, holderAsBytes)
+		}
+
+		if err = putOwner(stub, owner); err != nil {
+			return result, err
+		}
+		if err = stub.PutState(aadharKey(owner.Aadhar), []byte(name)); err != nil {
+			return result, errInternal("Failed to put Aadhar index: %s", err)
+		}
+		if err = stub.DelState(name); err != nil {
+			return result, errInternal("Failed to delete owner %s: %s", name, err)
+		}
+		result.Owners++
+	}
+
+	for _, key := range []string{legacyOwnerIndex, legacySurveyIndex} {
+		if err := stub.DelState(key); err != nil {
+			return result, errInternal("Failed to delete %s: %s", key, err)
+		}
+	}
+	logger.WithStub(stub).Infof("Migrated %d owners and %d surveys to prefixed keys", result.Owners, result.Surveys)
+	return result, nil
+}
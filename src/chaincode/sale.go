@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Sale agreements are kept under salePrefix+<id>, the ID being the
+// transaction ID of the proposal. Every open sale is also indexed under
+// salePartyPrefix+<name>~<id> for its seller and its buyer, so that the
+// pending sales of a party are served by a range query.
+var salePrefix = "sale" + keySeparator
+var salePartyPrefix = "saleparty" + keySeparator
+
+// Stages of a sale. A sale is proposed by the seller, accepted by the buyer,
+// which puts the survey in escrow, approved by a registrar and finalized by
+// transferring the share. It can be cancelled until it is finalized. A sale
+// past its deadline can no longer advance and stays open, holding any
+// escrow, until it is cancelled; readExpiredSales lists such sales.
+const (
+	saleProposed  = "proposed"
+	saleAccepted  = "accepted"
+	saleApproved  = "approved"
+	saleFinalized = "finalized"
+	saleCancelled = "cancelled"
+)
+
+// Sale struct stores a sale agreement between a seller and a buyer
+type Sale struct {
+	ID       string `json:"id"`
+	SurveyNo int64  `json:"surveyNo"`
+	Seller   string `json:"seller"`
+	Buyer    string `json:"buyer"`
+	Share    int64  `json:"share"`
+	Price    int64  `json:"price"`
+	Terms    string `json:"terms"`
+	Status   string `json:"status"`
+	Deadline string `json:"deadline"` // RFC3339 time the sale must be finalized by
+
+	ProposedTx  string `json:"proposedTx"`
+	AcceptedTx  string `json:"acceptedTx"`
+	ApprovedTx  string `json:"approvedTx"`
+	FinalizedTx string `json:"finalizedTx"`
+	CancelledTx string `json:"cancelledTx"`
+}
+
+// SalePage struct is the response of readPendingSales and readExpiredSales
+type SalePage struct {
+	Sales     []Sale `json:"sales"`
+	NextStart string `json:"nextStart"`
+	HasMore   bool   `json:"hasMore"`
+}
+
+func saleKey(id string) string {
+	return salePrefix + id
+}
+
+func salePartyKey(name string, id string) string {
+	return salePartyPrefix + name + keySeparator + id
+}
+
+// getSale : fetches a sale by its ID
+func getSale(stub shim.ChaincodeStubInterface, id string) (Sale, error) {
+	var sale Sale
+	saleAsBytes, err := stub.GetState(saleKey(id))
+	if err != nil {
+		return sale, errInternal("Failed to get sale %s: %s", id, err)
+	}
+	if saleAsBytes == nil {
+		return sale, errNotFound("Sale %s doesn't exist", id)
+	}
+	if err = json.Unmarshal(saleAsBytes, &sale); err != nil {
+		return sale, errInternal("Failed to decode sale %s: %s", id, err)
+	}
+	return sale, nil
+}
+
+// getSales : fetches several sales by their IDs in one round trip
+func getSales(stub shim.ChaincodeStubInterface, ids []string) ([]Sale, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = saleKey(id)
+	}
+	values, err := stub.GetStateMultiple(keys)
+	if err != nil {
+		return nil, errInternal("Failed to get sales: %s", err)
+	}
+
+	sales := make([]Sale, len(ids))
+	for i, id := range ids {
+		if values[i] == nil {
+			return nil, errNotFound("Sale %s doesn't exist", id)
+		}
+		if err = json.Unmarshal(values[i], &sales[i]); err != nil {
+			return nil, errInternal("Failed to decode sale %s: %s", id, err)
+		}
+	}
+	return sales, nil
+}
+
+// putSale : writes a sale and emits the event of the step that changed it
+func putSale(stub shim.ChaincodeStubInterface, sale Sale, event string) ([]byte, error) {
+	bytes, err := json.Marshal(sale)
+	if err != nil {
+		return nil, errInternal("Failed to encode sale %s: %s", sale.ID, err)
+	}
+	if err = stub.PutState(saleKey(sale.ID), bytes); err != nil {
+		return nil, errInternal("Failed to put sale %s: %s", sale.ID, err)
+	}
+	if err = stub.SetEvent(event, bytes); err != nil {
+		return nil, errInternal("Failed to set event %s: %s", event, err)
+	}
+	return bytes, nil
+}
+
+// closeSale : removes a finalized or cancelled sale from the pending sales
+// of its seller and buyer
+func closeSale(stub shim.ChaincodeStubInterface, sale Sale) error {
+	for _, name := range []string{sale.Seller, sale.Buyer} {
+		if err := stub.DelState(salePartyKey(name, sale.ID)); err != nil {
+			return errInternal("Failed to delete pending sale %s of %s: %s", sale.ID, name, err)
+		}
+	}
+	return nil
+}
+
+// txTime : the time of the current transaction
+func txTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, errInternal("Failed to get transaction time: %s", err)
+	}
+	if ts == nil {
+		return time.Time{}, errFailedPrecondition("Transaction carries no timestamp")
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// expired : whether the deadline of a sale has passed at the current
+// transaction time
+func expired(stub shim.ChaincodeStubInterface, sale Sale) (bool, error) {
+	now, err := txTime(stub)
+	if err != nil {
+		return false, err
+	}
+	deadline, err := time.Parse(time.RFC3339, sale.Deadline)
+	if err != nil {
+		return false, errInternal("Corrupt deadline of sale %s: %s", sale.ID, err)
+	}
+	return now.After(deadline), nil
+}
+
+// saleArgs : arguments naming a sale
+type saleArgs struct {
+	ID string `arg:"saleID"`
+}
+
+// advanceSale : fetches a sale that is about to move from stage from to the
+// next one, failing if it is in another stage or past its deadline
+func advanceSale(stub shim.ChaincodeStubInterface, args saleArgs, from string) (Sale, error) {
+	sale, err := getSale(stub, args.ID)
+	if err != nil {
+		return sale, err
+	}
+	if sale.Status != from {
+		return sale, errFailedPrecondition("Sale %s is %s, expected %s", sale.ID, sale.Status, from)
+	}
+	isExpired, err := expired(stub, sale)
+	if err != nil {
+		return sale, err
+	}
+	if isExpired {
+		return sale, errFailedPrecondition("Sale %s expired at %s", sale.ID, sale.Deadline)
+	}
+	return sale, nil
+}
+
+// proposeSaleArgs : arguments of proposeSale
+type proposeSaleArgs struct {
+	Seller   string `arg:"seller"`
+	SurveyNo int64  `arg:"surveyNo"`
+	Buyer    string `arg:"buyer"`
+	Share    int64  `arg:"share"`
+	Price    int64  `arg:"price"`
+	Terms    string `arg:"terms"`
+	Validity int64  `arg:"validitySeconds"`
+}
+
+// proposeSale : the seller offers a share of a survey to a buyer. Expects
+// seller, survey number, buyer, share, price, terms and the number of
+// seconds the offer stays open. The ID of the sale is the transaction ID.
+func (t *SimpleChaincode) proposeSale(stub shim.ChaincodeStubInterface, args proposeSaleArgs) ([]byte, error) {
+	sellerName, surveyNo, buyerName, share := args.Seller, args.SurveyNo, args.Buyer, args.Share
+	if err := checkSurveyNo(surveyNo); err != nil {
+		return nil, err
+	}
+	if err := checkPositive("Share", share); err != nil {
+		return nil, err
+	}
+	if err := checkPositive("Price", args.Price); err != nil {
+		return nil, err
+	}
+	if err := checkPositive("Validity", args.Validity); err != nil {
+		return nil, err
+	}
+	if sellerName == buyerName {
+		return nil, errInvalidArgument("Seller and buyer must be different owners")
+	}
+
+	if _, err := getOwner(stub, buyerName); err != nil {
+		return nil, err
+	}
+	seller, err := getOwner(stub, sellerName)
+	if err != nil {
+		return nil, err
+	}
+	survey, err := getActiveSurvey(stub, surveyNo)
+	if err != nil {
+		return nil, err
+	}
+	sellerShare := survey.Shares[sellerName]
+	if sellerShare == 0 || indexOfSurveyNo(seller.SurveyNos, surveyNo) == -1 {
+		return nil, errFailedPrecondition("%s does not own survey %d", sellerName, surveyNo)
+	}
+	if share > sellerShare {
+		return nil, errInvalidArgument("Share must be between 1 and %d, the seller's share of survey %d", sellerShare, surveyNo)
+	}
+	if survey.Escrow != "" {
+		return nil, errFailedPrecondition("Survey %d is held in escrow by sale %s", surveyNo, survey.Escrow)
+	}
+
+	now, err := txTime(stub)
+	if err != nil {
+		return nil, err
+	}
+	id := stub.GetTxID()
+	_, err = getSale(stub, id)
+	if err == nil {
+		return nil, errAlreadyExists("Sale %s already exists", id)
+	}
+	if registryErr, ok := err.(*RegistryError); !ok || registryErr.Code != codeNotFound {
+		return nil, err
+	}
+
+	sale := Sale{
+		ID:         id,
+		SurveyNo:   surveyNo,
+		Seller:     sellerName,
+		Buyer:      buyerName,
+		Share:      share,
+		Price:      args.Price,
+		Terms:      args.Terms,
+		Status:     saleProposed,
+		Deadline:   now.Add(time.Duration(args.Validity) * time.Second).Format(time.RFC3339),
+		ProposedTx: id,
+	}
+
+	for _, name := range []string{sellerName, buyerName} {
+		if err = stub.PutState(salePartyKey(name, id), []byte(id)); err != nil {
+			return nil, errInternal("Failed to put pending sale %s of %s: %s", id, name, err)
+		}
+	}
+	return putSale(stub, sale, "saleProposed")
+}
+
+// acceptSale : the buyer accepts a proposed sale. The survey is held in
+// escrow for the sale until it is finalized or cancelled. Expects sale ID.
+func (t *SimpleChaincode) acceptSale(stub shim.ChaincodeStubInterface, args saleArgs) ([]byte, error) {
+	sale, err := advanceSale(stub, args, saleProposed)
+	if err != nil {
+		return nil, err
+	}
+	survey, err := getActiveSurvey(stub, sale.SurveyNo)
+	if err != nil {
+		return nil, err
+	}
+	if survey.Escrow != "" {
+		return nil, errFailedPrecondition("Survey %d is held in escrow by sale %s", sale.SurveyNo, survey.Escrow)
+	}
+
+	survey.Escrow = sale.ID
+	sale.Status = saleAccepted
+	sale.AcceptedTx = stub.GetTxID()
+
+	if err = putSurvey(stub, survey); err != nil {
+		return nil, err
+	}
+	return putSale(stub, sale, "saleAccepted")
+}
+
+// approveSale : a registrar approves an accepted sale. Expects sale ID.
+func (t *SimpleChaincode) approveSale(stub shim.ChaincodeStubInterface, args saleArgs) ([]byte, error) {
+	sale, err := advanceSale(stub, args, saleAccepted)
+	if err != nil {
+		return nil, err
+	}
+
+	sale.Status = saleApproved
+	sale.ApprovedTx = stub.GetTxID()
+
+	return putSale(stub, sale, "saleApproved")
+}
+
+// finalizeSale : transfers the share of an approved sale to the buyer and
+// releases the escrow. Expects sale ID.
+func (t *SimpleChaincode) finalizeSale(stub shim.ChaincodeStubInterface, args saleArgs) ([]byte, error) {
+	sale, err := advanceSale(stub, args, saleApproved)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := prepareTransfer(stub, sale.Seller, sale.SurveyNo, sale.Buyer, sale.Share, sale.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	pending.survey.Escrow = ""
+	sale.Status = saleFinalized
+	sale.FinalizedTx = stub.GetTxID()
+
+	if err = pending.commit(stub); err != nil {
+		return nil, err
+	}
+	if err = closeSale(stub, sale); err != nil {
+		return nil, err
+	}
+	return putSale(stub, sale, "saleFinalized")
+}
+
+// cancelSale : withdraws a sale that has not been finalized, releasing the
+// escrow. The seller can withdraw a proposal and the buyer decline it at any
+// time. Once the buyer has accepted, either can only cancel after the
+// deadline has passed; a registrar can cancel at any time. Expects sale ID.
+func (t *SimpleChaincode) cancelSale(stub shim.ChaincodeStubInterface, args saleArgs) ([]byte, error) {
+	sale, err := getSale(stub, args.ID)
+	if err != nil {
+		return nil, err
+	}
+	if sale.Status == saleFinalized || sale.Status == saleCancelled {
+		return nil, errFailedPrecondition("Sale %s is already %s", sale.ID, sale.Status)
+	}
+
+	if sale.Status != saleProposed {
+		role, err := stub.ReadCertAttribute(roleAttribute)
+		if err != nil || string(role) != roleRegistrar {
+			isExpired, err := expired(stub, sale)
+			if err != nil {
+				return nil, err
+			}
+			if !isExpired {
+				return nil, errFailedPrecondition("Sale %s is %s and can only be cancelled by a registrar before %s", sale.ID, sale.Status, sale.Deadline)
+			}
+		}
+
+		survey, err := getSurvey(stub, sale.SurveyNo)
+		if err != nil {
+			return nil, err
+		}
+		if survey.Escrow == sale.ID {
+			survey.Escrow = ""
+			if err = putSurvey(stub, survey); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	sale.Status = saleCancelled
+	sale.CancelledTx = stub.GetTxID()
+
+	if err = closeSale(stub, sale); err != nil {
+		return nil, err
+	}
+	return putSale(stub, sale, "saleCancelled")
+}
+
+// readSale : read a sale agreement by its ID
+func (t *SimpleChaincode) readSale(stub shim.ChaincodeStubInterface, args saleArgs) (*Sale, error) {
+	sale, err := getSale(stub, args.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &sale, nil
+}
+
+// pendingSalesArgs : arguments of readPendingSales and readExpiredSales
+type pendingSalesArgs struct {
+	Party string `arg:"party"`
+	Start string `arg:"start,optional"`
+	Limit int    `arg:"limit,optional"`
+}
+
+// readPendingSales : lists the sales a party is seller or buyer in that are
+// neither finalized nor cancelled, ordered by sale ID. Sales past their
+// deadline are left out, they can only be cancelled. Expects the party's
+// name and optionally the sale ID to start from and the page size.
+func (t *SimpleChaincode) readPendingSales(stub shim.ChaincodeStubInterface, args pendingSalesArgs) (*SalePage, error) {
+	return listOpenSales(stub, args, false)
+}
+
+// readExpiredSales : lists the sales a party is seller or buyer in that are
+// past their deadline but neither finalized nor cancelled, ordered by sale ID,
+// so that they can be cancelled and any escrow they hold released. Expects
+// the party's name and optionally the sale ID to start from and the page size.
+func (t *SimpleChaincode) readExpiredSales(stub shim.ChaincodeStubInterface, args pendingSalesArgs) (*SalePage, error) {
+	return listOpenSales(stub, args, true)
+}
+
+// listOpenSales : lists the open sales of a party that are past their
+// deadline, or that are not
+func listOpenSales(stub shim.ChaincodeStubInterface, args pendingSalesArgs, wantExpired bool) (*SalePage, error) {
+	if err := checkName("Party name", args.Party); err != nil {
+		return nil, err
+	}
+	limit, err := pageLimit(args.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	// expired and unexpired sales share the index, so the range is scanned
+	// until the page is full
+	page := SalePage{Sales: []Sale{}}
+	prefix := salePartyPrefix + args.Party + keySeparator
+	start := args.Start
+	for {
+		entries, next, err := scanPage(stub, prefix, start, limit-len(page.Sales))
+		if err != nil {
+			return nil, err
+		}
+
+		ids := make([]string, len(entries))
+		for i, entry := range entries {
+			ids[i] = string(entry.value)
+		}
+		sales, err := getSales(stub, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, sale := range sales {
+			isExpired, err := expired(stub, sale)
+			if err != nil {
+				return nil, err
+			}
+			if isExpired == wantExpired {
+				page.Sales = append(page.Sales, sale)
+			}
+		}
+
+		if next == nil {
+			break
+		}
+		start = string(next.value)
+		if len(page.Sales) == limit {
+			page.NextStart = start
+			page.HasMore = true
+			break
+		}
+	}
+
+	return &page, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// aadharDigits is the length of an Aadhar number. Aadhar numbers never start
+// with 0 or 1.
+const aadharDigits = 12
+
+// parseSurveyNo : reads a survey number, which must be a positive integer
+func parseSurveyNo(arg string) (int64, error) {
+	surveyNo, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || surveyNo <= 0 {
+		return 0, errInvalidArgument("Survey number %q must be a positive integer", arg)
+	}
+	return surveyNo, nil
+}
+
+// checkSurveyNo : a survey number must be positive
+func checkSurveyNo(surveyNo int64) error {
+	if surveyNo <= 0 {
+		return errInvalidArgument("Survey number %d must be a positive integer", surveyNo)
+	}
+	return nil
+}
+
+// checkPositive : an area, share, price ... must be positive
+func checkPositive(name string, value int64) error {
+	if value <= 0 {
+		return errInvalidArgument("%s %d must be a positive integer", name, value)
+	}
+	return nil
+}
+
+// checkNonNegative : a count or sequence number may be 0
+func checkNonNegative(name string, value int64) error {
+	if value < 0 {
+		return errInvalidArgument("%s %d must be a non-negative integer", name, value)
+	}
+	return nil
+}
+
+// parseAadhar : reads an Aadhar number, 12 digits not starting with 0 or 1
+func parseAadhar(arg string) (int64, error) {
+	if len(arg) != aadharDigits || arg[0] < '2' || arg[0] > '9' {
+		return 0, errInvalidArgument("Aadhar number %q must be %d digits not starting with 0 or 1", arg, aadharDigits)
+	}
+	aadhar, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, errInvalidArgument("Aadhar number %q must be %d digits not starting with 0 or 1", arg, aadharDigits)
+	}
+	return aadhar, nil
+}
+
+// parsePositive : reads a positive integer argument such as an area or price
+func parsePositive(name string, arg string) (int64, error) {
+	value, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, errInvalidArgument("%s %q must be a positive integer", name, arg)
+	}
+	return value, nil
+}
+
+// parseNonNegative : reads an integer argument that may be 0
+func parseNonNegative(name string, arg string) (int64, error) {
+	value, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || value < 0 {
+		return 0, errInvalidArgument("%s %q must be a non-negative integer", name, arg)
+	}
+	return value, nil
+}
+
+// checkName : an owner name, location or holder is used in state keys, so it
+// must not be blank or contain the key separator
+func checkName(name string, arg string) error {
+	if strings.TrimSpace(arg) == "" {
+		return errInvalidArgument("%s must not be empty", name)
+	}
+	if strings.Contains(arg, keySeparator) {
+		return errInvalidArgument("%s %q may not contain %s", name, arg, keySeparator)
+	}
+	return nil
+}